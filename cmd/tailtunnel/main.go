@@ -43,6 +43,13 @@ func main() {
 		}
 	}()
 
+	// Proxied peer apps get their own port, and so their own origin
+	go func() {
+		if err := ts.ServeOn(handler.ProxyPort(), api.NewProxyRouter(handler)); err != nil {
+			log.Fatalf("Proxy server error: %v", err)
+		}
+	}()
+
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
@@ -1,5 +1,7 @@
 export type ConnectionType = 'direct' | 'derp' | 'peer-relay' | 'offline' | 'unknown';
 
+export type PingType = 'disco' | 'TSMP' | 'ICMP' | 'peerapi' | 'layered';
+
 export interface PeerInfo {
 	hostName: string;
 	dnsName: string;
@@ -29,6 +31,9 @@ export interface PingResult {
 	derpRegion?: string;
 	derpRegionId?: number;
 	peerRelay?: string;
+	type: PingType;
+	failedLayer?: PingType;
+	layers?: PingResult[];
 }
 
 export interface PeersResponse {
@@ -38,10 +43,30 @@ export interface PeersResponse {
 
 export interface PingRequest {
 	ip: string;
-	type?: string;
+	type?: PingType;
 }
 
 export interface PingAllResponse {
 	results: PingResult[];
 	timestamp: string;
 }
+
+export interface PathState {
+	connectionType: ConnectionType;
+	endpoint?: string;
+	derpRegion?: string;
+	peerRelay?: string;
+}
+
+export interface PathEvent {
+	time: string;
+	peer: string;
+	ip: string;
+	before: PathState;
+	after: PathState;
+	changed: ('connectionType' | 'endpoint' | 'derpRegion' | 'peerRelay')[];
+}
+
+export interface PathEventsResponse {
+	events: PathEvent[];
+}
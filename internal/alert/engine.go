@@ -0,0 +1,452 @@
+package alert
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rajsinghtech/tailtunnel/internal/canary"
+	"github.com/rajsinghtech/tailtunnel/internal/policy"
+	"github.com/rajsinghtech/tailtunnel/internal/tailscale"
+)
+
+// maxResolved is how many resolved alerts are kept to show alongside the
+// active ones.
+const maxResolved = 100
+
+// State is where an alert is in its life cycle.
+type State string
+
+const (
+	// StatePending alerts have a condition that holds, but not yet for the
+	// rule's For duration.
+	StatePending State = "pending"
+	// StateFiring alerts have held for For and are notified.
+	StateFiring State = "firing"
+	// StateResolved alerts no longer hold.
+	StateResolved State = "resolved"
+)
+
+// Alert is a rule's condition holding for one peer. There is at most one
+// active alert per rule and peer, which is what deduplicates notifications.
+type Alert struct {
+	ID          string     `json:"id"`
+	Rule        string     `json:"rule"`
+	Peer        string     `json:"peer"`
+	IP          string     `json:"ip"`
+	Tags        []string   `json:"tags,omitempty"`
+	Severity    string     `json:"severity"`
+	State       State      `json:"state"`
+	Value       float64    `json:"value"`
+	Description string     `json:"description"`
+	ActiveSince time.Time  `json:"activeSince"`
+	FiredAt     *time.Time `json:"firedAt,omitempty"`
+	ResolvedAt  *time.Time `json:"resolvedAt,omitempty"`
+	SilencedBy  string     `json:"silencedBy,omitempty"`
+
+	receivers  []string
+	notifiedAt time.Time
+}
+
+// Engine evaluates alert rules against each round of canary pings and
+// notifies receivers as alerts fire and resolve. Rules are read from a
+// JSON File that is reloaded when it changes on disk.
+type Engine struct {
+	path     string
+	silences *Silences
+	client   *http.Client
+
+	mu       sync.Mutex
+	cfg      *config
+	modTime  time.Time
+	peers    map[string]*peerState // by IP
+	alerts   map[string]*Alert     // pending and firing, by ID
+	resolved []Alert
+}
+
+// peerState is what the engine remembers about a peer between rounds.
+type peerState struct {
+	samples []canary.Sample
+	// path is the connection type of the last successful ping, or offline.
+	path canary.ConnectionType
+}
+
+// NewEngine returns an engine reading rules from path and keeping silences
+// in silencesPath.
+func NewEngine(path, silencesPath string) (*Engine, error) {
+	silences, err := loadSilences(silencesPath)
+	if err != nil {
+		return nil, err
+	}
+	e := &Engine{
+		path:     path,
+		silences: silences,
+		client:   &http.Client{},
+		cfg:      &config{receivers: map[string]*receiver{}},
+		peers:    make(map[string]*peerState),
+		alerts:   make(map[string]*Alert),
+	}
+	e.mu.Lock()
+	e.reloadLocked()
+	e.mu.Unlock()
+	return e, nil
+}
+
+func (e *Engine) reloadLocked() {
+	stat, err := os.Stat(e.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to stat alert rules %s: %v", e.path, err)
+		}
+		return
+	}
+	if stat.ModTime().Equal(e.modTime) {
+		return
+	}
+
+	data, err := os.ReadFile(e.path)
+	if err != nil {
+		log.Printf("Failed to read alert rules %s: %v", e.path, err)
+		return
+	}
+
+	var f File
+	if err := json.Unmarshal(data, &f); err != nil {
+		log.Printf("Failed to parse alert rules %s: %v", e.path, err)
+		return
+	}
+	cfg, err := compile(&f)
+	if err != nil {
+		// Keep evaluating the last good rules.
+		log.Printf("Invalid alert rules %s: %v", e.path, err)
+		return
+	}
+
+	e.cfg = cfg
+	e.modTime = stat.ModTime()
+	log.Printf("Loaded alert rules from %s (%d rules, %d receivers)", e.path, len(cfg.rules), len(cfg.receivers))
+}
+
+// Observe evaluates every rule against a round of canary pings. It is
+// registered with canary.Scheduler.OnRound; notifications are sent in the
+// background so the scheduler isn't held up by slow receivers.
+func (e *Engine) Observe(round canary.Round) {
+	now := round.Time
+
+	e.mu.Lock()
+	e.reloadLocked()
+	cfg := e.cfg
+
+	seenPeers := make(map[string]bool, len(round.Peers))
+	for i, peer := range round.Peers {
+		seenPeers[peer.IP] = true
+		e.record(peer, round.Samples[i], now, cfg.maxWindow)
+	}
+	for ip := range e.peers {
+		if !seenPeers[ip] {
+			delete(e.peers, ip)
+		}
+	}
+
+	var notifications []pendingNotification
+	seen := make(map[string]bool)
+	for _, r := range cfg.rules {
+		for i, peer := range round.Peers {
+			if len(r.Peers) > 0 && !matchesPeer(r.Peers, round.Samples[i].Peer, peer.IP, peer.Tags) {
+				continue
+			}
+			active, value, desc := r.evaluate(e.peers[peer.IP], peer, now)
+			id := r.Name + "/" + round.Samples[i].Peer
+			a := e.alerts[id]
+			if !active {
+				if a != nil {
+					if desc != "" {
+						a.Value, a.Description = value, desc
+					}
+					notifications = e.resolveLocked(a, now, notifications)
+				}
+				continue
+			}
+			seen[id] = true
+
+			if a == nil {
+				a = &Alert{
+					ID:          id,
+					Rule:        r.Name,
+					Peer:        round.Samples[i].Peer,
+					IP:          peer.IP,
+					Tags:        peer.Tags,
+					State:       StatePending,
+					ActiveSince: now,
+				}
+				e.alerts[id] = a
+			}
+			a.Severity = r.Severity
+			a.Value = value
+			a.Description = desc
+			a.receivers = r.Receivers
+			if a.State == StatePending && now.Sub(a.ActiveSince) >= r.hold {
+				a.State = StateFiring
+				a.FiredAt = &now
+				log.Printf("Alert %s firing: %s", a.ID, a.Description)
+			}
+			notifications = e.notifyFiringLocked(a, cfg, now, notifications)
+		}
+	}
+
+	// Alerts whose rule was removed, or whose peer left the tailnet or no
+	// longer matches, resolve too.
+	for id, a := range e.alerts {
+		if !seen[id] {
+			notifications = e.resolveLocked(a, now, notifications)
+		}
+	}
+	e.mu.Unlock()
+
+	for _, pn := range notifications {
+		go e.deliver(pn)
+	}
+}
+
+func (e *Engine) record(peer canary.PeerInfo, sample canary.Sample, now time.Time, window time.Duration) {
+	ps := e.peers[peer.IP]
+	if ps == nil {
+		ps = &peerState{}
+		e.peers[peer.IP] = ps
+	}
+
+	switch {
+	case !peer.Online:
+		ps.path = canary.ConnectionOffline
+	case sample.Success:
+		ps.path = sample.ConnectionType
+	}
+
+	ps.samples = append(ps.samples, sample)
+	cutoff := now.Add(-window)
+	i := 0
+	for i < len(ps.samples) && !ps.samples[i].Time.After(cutoff) {
+		i++
+	}
+	ps.samples = slices.Clone(ps.samples[i:])
+}
+
+type pendingNotification struct {
+	receiver     *receiver
+	notification Notification
+}
+
+// notifyFiringLocked queues a notification for a firing alert that hasn't
+// been notified yet, or not for the repeat interval, unless it is silenced.
+func (e *Engine) notifyFiringLocked(a *Alert, cfg *config, now time.Time, queue []pendingNotification) []pendingNotification {
+	a.SilencedBy = e.silences.match(a, now)
+	if a.State != StateFiring || a.SilencedBy != "" {
+		return queue
+	}
+	if !a.notifiedAt.IsZero() && (cfg.repeat == 0 || now.Sub(a.notifiedAt) < cfg.repeat) {
+		return queue
+	}
+	a.notifiedAt = now
+	return e.queueLocked(cfg, *a, queue)
+}
+
+// resolveLocked ends alert a. Only alerts that were notified as firing are
+// notified as resolved; pending alerts just disappear.
+func (e *Engine) resolveLocked(a *Alert, now time.Time, queue []pendingNotification) []pendingNotification {
+	delete(e.alerts, a.ID)
+	if a.State != StateFiring {
+		return queue
+	}
+
+	a.State = StateResolved
+	a.ResolvedAt = &now
+	log.Printf("Alert %s resolved", a.ID)
+
+	e.resolved = append(e.resolved, *a)
+	if n := len(e.resolved) - maxResolved; n > 0 {
+		e.resolved = slices.Clone(e.resolved[n:])
+	}
+
+	a.SilencedBy = e.silences.match(a, now)
+	if a.notifiedAt.IsZero() || a.SilencedBy != "" {
+		return queue
+	}
+	return e.queueLocked(e.cfg, *a, queue)
+}
+
+func (e *Engine) queueLocked(cfg *config, a Alert, queue []pendingNotification) []pendingNotification {
+	n := newNotification(a)
+	for name, r := range cfg.receivers {
+		if len(a.receivers) == 0 || slices.Contains(a.receivers, name) {
+			queue = append(queue, pendingNotification{receiver: r, notification: n})
+		}
+	}
+	return queue
+}
+
+func (e *Engine) deliver(pn pendingNotification) {
+	if err := send(context.Background(), e.client, pn.receiver, pn.notification); err != nil {
+		log.Printf("Failed to notify %s of alert %s: %v", pn.receiver.Name, pn.notification.Alert.ID, err)
+	}
+}
+
+// Alerts returns the pending and firing alerts, firing first, followed by
+// the most recently resolved ones.
+func (e *Engine) Alerts() []Alert {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	alerts := make([]Alert, 0, len(e.alerts)+len(e.resolved))
+	for _, a := range e.alerts {
+		alerts = append(alerts, *a)
+	}
+	sort.Slice(alerts, func(i, j int) bool {
+		if alerts[i].State != alerts[j].State {
+			return alerts[i].State == StateFiring
+		}
+		return alerts[i].ActiveSince.Before(alerts[j].ActiveSince)
+	})
+	for i := len(e.resolved) - 1; i >= 0; i-- {
+		alerts = append(alerts, e.resolved[i])
+	}
+	return alerts
+}
+
+// ReceiverInfo describes a receiver without its URL, which often embeds a
+// secret.
+type ReceiverInfo struct {
+	Name   string `json:"name"`
+	Format string `json:"format"`
+}
+
+// Rules returns the rules in effect and the receivers they notify.
+func (e *Engine) Rules() ([]Rule, []ReceiverInfo) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.reloadLocked()
+
+	rules := []Rule{}
+	for _, r := range e.cfg.rules {
+		rules = append(rules, r.Rule)
+	}
+	receivers := []ReceiverInfo{}
+	for _, r := range e.cfg.receivers {
+		receivers = append(receivers, ReceiverInfo{Name: r.Name, Format: r.Format})
+	}
+	sort.Slice(receivers, func(i, j int) bool {
+		return receivers[i].Name < receivers[j].Name
+	})
+	return rules, receivers
+}
+
+// Silences returns the engine's silences.
+func (e *Engine) Silences() *Silences {
+	return e.silences
+}
+
+// Test sends a made-up firing alert to the named receiver and returns the
+// delivery error, if any.
+func (e *Engine) Test(ctx context.Context, name string) error {
+	e.mu.Lock()
+	e.reloadLocked()
+	r := e.cfg.receivers[name]
+	e.mu.Unlock()
+	if r == nil {
+		return ErrNotFound
+	}
+
+	now := time.Now()
+	n := newNotification(Alert{
+		ID:          "test/tailtunnel",
+		Rule:        "test",
+		Peer:        "tailtunnel",
+		Severity:    defaultSeverity,
+		State:       StateFiring,
+		Description: "This is a test notification from TailTunnel",
+		ActiveSince: now,
+		FiredAt:     &now,
+	})
+	n.Test = true
+	return send(ctx, e.client, r, n)
+}
+
+// evaluate reports whether r's condition holds for a peer, with the value
+// measured and a description for notifications.
+func (r *rule) evaluate(ps *peerState, peer canary.PeerInfo, now time.Time) (bool, float64, string) {
+	switch r.Condition {
+	case ConditionOffline:
+		if peer.Online {
+			return false, 0, "peer is online"
+		}
+		return true, 0, "peer is offline"
+
+	case ConditionDERP:
+		if ps.path != canary.ConnectionDERP {
+			return false, 0, fmt.Sprintf("connection is %s", ps.path)
+		}
+		return true, 0, "traffic is relayed through DERP"
+
+	case ConditionLatency:
+		var latencies []float64
+		for _, s := range ps.samples {
+			if s.Success && now.Sub(s.Time) < r.window {
+				latencies = append(latencies, s.LatencyMs)
+			}
+		}
+		if len(latencies) == 0 {
+			return false, 0, ""
+		}
+		v := percentile(latencies, r.Percentile)
+		return v > r.Threshold, v, fmt.Sprintf("latency p%g over %s is %.1fms (threshold %gms)", r.Percentile, r.window, v, r.Threshold)
+
+	case ConditionLoss:
+		if !peer.Online {
+			return false, 0, ""
+		}
+		count, failures := 0, 0
+		for _, s := range ps.samples {
+			if s.ConnectionType == canary.ConnectionOffline || now.Sub(s.Time) >= r.window {
+				continue
+			}
+			count++
+			if !s.Success {
+				failures++
+			}
+		}
+		if count == 0 {
+			return false, 0, ""
+		}
+		v := 100 * float64(failures) / float64(count)
+		return v > r.Threshold, v, fmt.Sprintf("%.0f%% of pings over %s failed (threshold %g%%)", v, r.window, r.Threshold)
+	}
+	return false, 0, ""
+}
+
+// percentile returns the nearest-rank p-th percentile of values, which it
+// sorts.
+func percentile(values []float64, p float64) float64 {
+	sort.Float64s(values)
+	rank := int(math.Ceil(p / 100 * float64(len(values))))
+	return values[min(max(rank, 1), len(values))-1]
+}
+
+// matchesPeer reports whether a peer matches any of selectors, using the
+// policy's destination syntax.
+func matchesPeer(selectors []string, dnsName, ip string, tags []string) bool {
+	host, _, _ := strings.Cut(dnsName, ".")
+	return policy.MatchesMachine(selectors, &tailscale.Machine{
+		HostName:     host,
+		DNSName:      dnsName,
+		TailscaleIPs: []string{ip},
+		Tags:         tags,
+	})
+}
@@ -0,0 +1,196 @@
+package alert
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rajsinghtech/tailtunnel/internal/canary"
+)
+
+type received struct {
+	path string
+	body string
+}
+
+// newReceiver starts a server that passes every request it gets to the
+// returned channel.
+func newReceiver(t *testing.T) (*httptest.Server, chan received) {
+	ch := make(chan received, 16)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		ch <- received{path: r.URL.Path, body: string(body)}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, ch
+}
+
+// expect waits for n notifications and returns their bodies by path.
+func expect(t *testing.T, ch chan received, n int) map[string]string {
+	t.Helper()
+	got := make(map[string]string)
+	for range n {
+		select {
+		case r := <-ch:
+			got[r.path] = r.body
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %d notifications, want %d", len(got), n)
+		}
+	}
+	return got
+}
+
+func expectNone(t *testing.T, ch chan received) {
+	t.Helper()
+	select {
+	case r := <-ch:
+		t.Fatalf("unexpected notification to %s: %s", r.path, r.body)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func newTestEngine(t *testing.T, url string) *Engine {
+	t.Helper()
+	dir := t.TempDir()
+	rules := `{
+	  "rules": [
+	    {"name": "slow", "peers": ["tag:prod"], "condition": "latency", "threshold": 100, "percentile": 50, "for": "1m"}
+	  ],
+	  "receivers": [
+	    {"name": "hook", "url": "` + url + `/hook"},
+	    {"name": "chat", "url": "` + url + `/chat", "template": "{\"msg\": {{json .Text}}, \"status\": {{json .Status}}}"}
+	  ]
+	}`
+	path := filepath.Join(dir, "alerts.json")
+	if err := os.WriteFile(path, []byte(rules), 0600); err != nil {
+		t.Fatal(err)
+	}
+	e, err := NewEngine(path, filepath.Join(dir, "silences.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func round(at time.Time, latencyMs float64) canary.Round {
+	return canary.Round{
+		Time: at,
+		Peers: []canary.PeerInfo{
+			{HostName: "web-1", DNSName: "web-1.example.ts.net", IP: "100.64.0.1", Online: true, Tags: []string{"tag:prod"}},
+			{HostName: "dev-1", DNSName: "dev-1.example.ts.net", IP: "100.64.0.2", Online: true, Tags: []string{"tag:dev"}},
+		},
+		Samples: []canary.Sample{
+			{Time: at, Peer: "web-1.example.ts.net", IP: "100.64.0.1", Success: true, LatencyMs: latencyMs, ConnectionType: canary.ConnectionDirect},
+			{Time: at, Peer: "dev-1.example.ts.net", IP: "100.64.0.2", Success: true, LatencyMs: latencyMs, ConnectionType: canary.ConnectionDirect},
+		},
+	}
+}
+
+func TestEngineFiresAndResolves(t *testing.T) {
+	srv, ch := newReceiver(t)
+	e := newTestEngine(t, srv.URL)
+	start := time.Now()
+
+	e.Observe(round(start, 250))
+	alerts := e.Alerts()
+	if len(alerts) != 1 || alerts[0].State != StatePending || alerts[0].Peer != "web-1.example.ts.net" {
+		t.Fatalf("after first slow round, alerts = %+v, want one pending alert for web-1", alerts)
+	}
+	expectNone(t, ch)
+
+	e.Observe(round(start.Add(time.Minute), 250))
+	got := expect(t, ch, 2)
+
+	var n Notification
+	if err := json.Unmarshal([]byte(got["/hook"]), &n); err != nil {
+		t.Fatalf("webhook payload %q: %v", got["/hook"], err)
+	}
+	if n.Status != StateFiring || n.Alert.Rule != "slow" || n.Alert.Value != 250 {
+		t.Errorf("webhook notification = %+v, want slow firing at 250", n)
+	}
+	var chat struct{ Msg, Status string }
+	if err := json.Unmarshal([]byte(got["/chat"]), &chat); err != nil {
+		t.Fatalf("template payload %q: %v", got["/chat"], err)
+	}
+	if chat.Status != "firing" || !strings.HasPrefix(chat.Msg, "[FIRING] slow on web-1.example.ts.net: latency p50") {
+		t.Errorf("template payload = %+v", chat)
+	}
+
+	// Still firing within the repeat interval: no new notification.
+	e.Observe(round(start.Add(90*time.Second), 250))
+	expectNone(t, ch)
+
+	e.Observe(round(start.Add(3*time.Minute), 20))
+	got = expect(t, ch, 2)
+	if err := json.Unmarshal([]byte(got["/hook"]), &n); err != nil {
+		t.Fatal(err)
+	}
+	if n.Status != StateResolved || n.Alert.ResolvedAt == nil {
+		t.Errorf("webhook notification = %+v, want resolved", n)
+	}
+	if !strings.Contains(got["/chat"], `"status": "resolved"`) {
+		t.Errorf("template payload = %s, want resolved", got["/chat"])
+	}
+
+	alerts = e.Alerts()
+	if len(alerts) != 1 || alerts[0].State != StateResolved {
+		t.Errorf("after recovery, alerts = %+v, want one resolved alert", alerts)
+	}
+	expectNone(t, ch)
+}
+
+func TestEngineSilences(t *testing.T) {
+	srv, ch := newReceiver(t)
+	e := newTestEngine(t, srv.URL)
+	start := time.Now()
+
+	silence, err := e.Silences().Add(SilenceRequest{Rule: "slow", Peers: []string{"web-1"}, Duration: "1h"}, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e.Observe(round(start, 250))
+	e.Observe(round(start.Add(time.Minute), 250))
+	alerts := e.Alerts()
+	if len(alerts) != 1 || alerts[0].State != StateFiring || alerts[0].SilencedBy != silence.ID {
+		t.Fatalf("alerts = %+v, want one firing alert silenced by %s", alerts, silence.ID)
+	}
+
+	// Resolving an alert that was never notified stays quiet too.
+	e.Observe(round(start.Add(3*time.Minute), 20))
+	expectNone(t, ch)
+
+	if _, err := e.Silences().Delete(silence.ID); err != nil {
+		t.Fatal(err)
+	}
+	e.Observe(round(start.Add(4*time.Minute), 250))
+	e.Observe(round(start.Add(5*time.Minute), 250))
+	expect(t, ch, 2)
+}
+
+func TestEngineTestReceiver(t *testing.T) {
+	srv, ch := newReceiver(t)
+	e := newTestEngine(t, srv.URL)
+
+	if err := e.Test(t.Context(), "hook"); err != nil {
+		t.Fatal(err)
+	}
+	got := expect(t, ch, 1)
+	var n Notification
+	if err := json.Unmarshal([]byte(got["/hook"]), &n); err != nil {
+		t.Fatal(err)
+	}
+	if !n.Test || n.Status != StateFiring {
+		t.Errorf("test notification = %+v", n)
+	}
+
+	if err := e.Test(t.Context(), "missing"); err != ErrNotFound {
+		t.Errorf("Test of unknown receiver = %v, want ErrNotFound", err)
+	}
+}
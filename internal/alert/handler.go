@@ -0,0 +1,116 @@
+package alert
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rajsinghtech/tailtunnel/internal/audit"
+	"github.com/rajsinghtech/tailtunnel/internal/identity"
+)
+
+type Handler struct {
+	engine *Engine
+	audit  *audit.Logger
+}
+
+func NewHandler(engine *Engine, audit *audit.Logger) *Handler {
+	return &Handler{engine: engine, audit: audit}
+}
+
+// List returns the pending and firing alerts and the latest resolved ones.
+func (h *Handler) List(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"alerts": h.engine.Alerts()})
+}
+
+// Rules returns the rules in effect and the names of the receivers.
+func (h *Handler) Rules(w http.ResponseWriter, r *http.Request) {
+	rules, receivers := h.engine.Rules()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"rules":     rules,
+		"receivers": receivers,
+	})
+}
+
+func (h *Handler) ListSilences(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.engine.Silences().List())
+}
+
+// CreateSilence adds the JSON-encoded SilenceRequest in the body.
+func (h *Handler) CreateSilence(w http.ResponseWriter, r *http.Request) {
+	var req SilenceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	silence, err := h.engine.Silences().Add(req, identity.LoginName(r.Context()))
+	if err != nil {
+		log.Printf("Failed to create silence: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.log(r, "create", silence)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(silence)
+}
+
+func (h *Handler) DeleteSilence(w http.ResponseWriter, r *http.Request) {
+	silence, err := h.engine.Silences().Delete(chi.URLParam(r, "id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	h.log(r, "delete", silence)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// TestReceiver sends a test notification to the receiver named in the
+// path, responding with the error if delivery failed.
+func (h *Handler) TestReceiver(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	if err := h.engine.Test(r.Context(), name); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			http.Error(w, "receiver not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Test notification to %s failed: %v", name, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"receiver": name, "status": "sent"})
+}
+
+func (h *Handler) log(r *http.Request, op string, silence *Silence) {
+	ev := audit.NewEvent(r.Context(), audit.ActionAlertSilence)
+	ev.Outcome = audit.OutcomeSuccess
+	ev.Details = map[string]any{
+		"op":      op,
+		"silence": silence.ID,
+		"rule":    silence.Rule,
+		"peers":   silence.Peers,
+		"comment": silence.Comment,
+		"endsAt":  silence.EndsAt,
+	}
+	h.audit.Log(ev)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "silence not found", http.StatusNotFound)
+		return
+	}
+	log.Printf("Silence error: %v", err)
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
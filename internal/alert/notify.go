@@ -0,0 +1,86 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const notifyTimeout = 10 * time.Second
+
+// Notification is sent to receivers when an alert fires, fires again after
+// the repeat interval, or resolves. It is the JSON payload of webhook
+// receivers and the data of receiver templates.
+type Notification struct {
+	Status State  `json:"status"`
+	Alert  Alert  `json:"alert"`
+	Title  string `json:"title"`
+	Text   string `json:"text"`
+	// Test is set on notifications sent by the test endpoint.
+	Test bool `json:"test,omitempty"`
+}
+
+func newNotification(a Alert) Notification {
+	n := Notification{Status: a.State, Alert: a}
+	n.Title = fmt.Sprintf("[%s] %s on %s", strings.ToUpper(string(a.State)), a.Rule, a.Peer)
+	n.Text = n.Title + ": " + a.Description
+	return n
+}
+
+// send delivers n to r, failing on any response other than 2xx.
+func send(ctx context.Context, client *http.Client, r *receiver, n Notification) error {
+	var body bytes.Buffer
+	if r.tmpl != nil {
+		if err := r.tmpl.Execute(&body, n); err != nil {
+			return fmt.Errorf("failed to render template: %w", err)
+		}
+	} else if err := json.NewEncoder(&body).Encode(n); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, notifyTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.URL, &body)
+	if err != nil {
+		return err
+	}
+	if r.Format == "ntfy" {
+		req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+		req.Header.Set("Title", n.Title)
+		req.Header.Set("Tags", ntfyTags(n))
+		if n.Status == StateFiring && n.Alert.Severity == "critical" {
+			req.Header.Set("Priority", "high")
+		}
+	} else {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range r.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+func ntfyTags(n Notification) string {
+	if n.Status == StateResolved {
+		return "white_check_mark"
+	}
+	return "warning"
+}
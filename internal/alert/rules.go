@@ -0,0 +1,243 @@
+package alert
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	defaultWindow         = 5 * time.Minute
+	defaultPercentile     = 95
+	defaultSeverity       = "warning"
+	defaultRepeatInterval = 4 * time.Hour
+)
+
+// File is the on-disk alerting configuration, for example:
+//
+//	{
+//	  "rules": [
+//	    {"name": "prod-latency", "peers": ["tag:prod"], "condition": "latency", "threshold": 150, "for": "5m"},
+//	    {"name": "peer-offline", "condition": "offline", "for": "10m", "severity": "critical"},
+//	    {"name": "on-derp", "condition": "derp", "for": "30m"}
+//	  ],
+//	  "receivers": [
+//	    {"name": "slack", "url": "https://hooks.slack.com/services/...", "format": "slack"}
+//	  ]
+//	}
+type File struct {
+	Rules     []Rule     `json:"rules"`
+	Receivers []Receiver `json:"receivers"`
+
+	// RepeatInterval is how often a firing alert is notified again, such
+	// as "4h" (the default). "0" notifies each alert only once.
+	RepeatInterval string `json:"repeatInterval,omitempty"`
+}
+
+// Condition is what a rule checks each peer for.
+type Condition string
+
+const (
+	// ConditionLatency is true while the Percentile of ping latency over
+	// the Window is above Threshold milliseconds.
+	ConditionLatency Condition = "latency"
+	// ConditionLoss is true while the percentage of pings of an online peer
+	// that failed over the Window is above Threshold.
+	ConditionLoss Condition = "loss"
+	// ConditionOffline is true while the peer is offline.
+	ConditionOffline Condition = "offline"
+	// ConditionDERP is true while traffic to the peer is relayed through
+	// DERP.
+	ConditionDERP Condition = "derp"
+)
+
+// Rule raises an alert for each peer matching Peers for which Condition has
+// held for For.
+type Rule struct {
+	Name string `json:"name"`
+	// Peers use the syntax of policy rule destinations: hostnames, MagicDNS
+	// names, Tailscale IPs, "tag:<name>" or "*". Empty matches every peer.
+	Peers      []string  `json:"peers,omitempty"`
+	Condition  Condition `json:"condition"`
+	Threshold  float64   `json:"threshold,omitempty"`
+	Percentile float64   `json:"percentile,omitempty"`
+	// Window is the span latency and loss are measured over. It defaults
+	// to For, or 5m if For is zero.
+	Window   string `json:"window,omitempty"`
+	For      string `json:"for,omitempty"`
+	Severity string `json:"severity,omitempty"`
+	// Receivers names where notifications go. Empty sends them to every
+	// receiver.
+	Receivers []string `json:"receivers,omitempty"`
+}
+
+// Receiver is a URL notifications are POSTed to. Format selects the payload:
+// "webhook" (the default) sends the Notification as JSON, "slack" and
+// "discord" send their incoming webhook JSON, and "ntfy" publishes to the
+// ntfy topic URL. Template, a Go text/template over the Notification,
+// replaces the payload of any format.
+type Receiver struct {
+	Name     string            `json:"name"`
+	URL      string            `json:"url"`
+	Format   string            `json:"format,omitempty"`
+	Template string            `json:"template,omitempty"`
+	Headers  map[string]string `json:"headers,omitempty"`
+}
+
+// formatTemplates are the payloads of the formats other than "webhook".
+var formatTemplates = map[string]string{
+	"slack":   `{"text": {{json .Text}}}`,
+	"discord": `{"content": {{json .Text}}}`,
+	"ntfy":    `{{.Text}}`,
+}
+
+var templateFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	"upper": strings.ToUpper,
+}
+
+// config is a File checked and ready to evaluate.
+type config struct {
+	rules     []*rule
+	receivers map[string]*receiver
+	repeat    time.Duration
+	// maxWindow is the longest window of any rule, which is how much
+	// history is kept for each peer.
+	maxWindow time.Duration
+}
+
+type rule struct {
+	Rule
+	window time.Duration
+	hold   time.Duration
+}
+
+type receiver struct {
+	Receiver
+	tmpl *template.Template
+}
+
+func compile(f *File) (*config, error) {
+	cfg := &config{
+		receivers: make(map[string]*receiver),
+		repeat:    defaultRepeatInterval,
+	}
+	if f.RepeatInterval != "" {
+		d, err := time.ParseDuration(f.RepeatInterval)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid repeatInterval %q", f.RepeatInterval)
+		}
+		cfg.repeat = d
+	}
+
+	for _, rc := range f.Receivers {
+		r, err := compileReceiver(rc)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := cfg.receivers[r.Name]; ok {
+			return nil, fmt.Errorf("duplicate receiver %q", r.Name)
+		}
+		cfg.receivers[r.Name] = r
+	}
+
+	names := make(map[string]bool)
+	for _, rl := range f.Rules {
+		r, err := compileRule(rl)
+		if err != nil {
+			return nil, err
+		}
+		if names[r.Name] {
+			return nil, fmt.Errorf("duplicate rule %q", r.Name)
+		}
+		names[r.Name] = true
+		for _, name := range r.Receivers {
+			if _, ok := cfg.receivers[name]; !ok {
+				return nil, fmt.Errorf("rule %q: unknown receiver %q", r.Name, name)
+			}
+		}
+		cfg.rules = append(cfg.rules, r)
+		cfg.maxWindow = max(cfg.maxWindow, r.window)
+	}
+	return cfg, nil
+}
+
+func compileRule(rl Rule) (*rule, error) {
+	r := &rule{Rule: rl}
+	if r.Name == "" {
+		return nil, fmt.Errorf("rule without a name")
+	}
+	if r.Severity == "" {
+		r.Severity = defaultSeverity
+	}
+
+	var err error
+	if r.For != "" {
+		if r.hold, err = time.ParseDuration(r.For); err != nil || r.hold < 0 {
+			return nil, fmt.Errorf("rule %q: invalid for %q", r.Name, r.For)
+		}
+	}
+
+	switch r.Condition {
+	case ConditionLatency, ConditionLoss:
+		r.window = r.hold
+		if r.window == 0 {
+			r.window = defaultWindow
+		}
+		if r.Window != "" {
+			if r.window, err = time.ParseDuration(r.Window); err != nil || r.window <= 0 {
+				return nil, fmt.Errorf("rule %q: invalid window %q", r.Name, r.Window)
+			}
+		}
+		if r.Threshold <= 0 {
+			return nil, fmt.Errorf("rule %q: %s needs a positive threshold", r.Name, r.Condition)
+		}
+		if r.Percentile == 0 {
+			r.Percentile = defaultPercentile
+		}
+		if r.Percentile < 0 || r.Percentile > 100 {
+			return nil, fmt.Errorf("rule %q: percentile must be between 0 and 100", r.Name)
+		}
+	case ConditionOffline, ConditionDERP:
+	default:
+		return nil, fmt.Errorf("rule %q: unknown condition %q, expected latency, loss, offline or derp", r.Name, r.Condition)
+	}
+	return r, nil
+}
+
+func compileReceiver(rc Receiver) (*receiver, error) {
+	r := &receiver{Receiver: rc}
+	if r.Name == "" {
+		return nil, fmt.Errorf("receiver without a name")
+	}
+	u, err := url.Parse(r.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("receiver %q: invalid url", r.Name)
+	}
+
+	text := r.Template
+	switch r.Format {
+	case "", "webhook":
+		r.Format = "webhook"
+	case "slack", "discord", "ntfy":
+		if text == "" {
+			text = formatTemplates[r.Format]
+		}
+	default:
+		return nil, fmt.Errorf("receiver %q: unknown format %q, expected webhook, slack, discord or ntfy", r.Name, r.Format)
+	}
+
+	if text != "" {
+		r.tmpl, err = template.New(r.Name).Funcs(templateFuncs).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("receiver %q: invalid template: %w", r.Name, err)
+		}
+	}
+	return r, nil
+}
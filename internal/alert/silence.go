@@ -0,0 +1,190 @@
+package alert
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned for silences and receivers that don't exist.
+var ErrNotFound = errors.New("not found")
+
+// Silence stops notifications for the alerts it matches until EndsAt. The
+// alerts themselves still change state, so they notify again once the
+// silence ends if they are still firing.
+type Silence struct {
+	ID string `json:"id"`
+	// Rule matches alerts of the named rule; empty matches every rule.
+	Rule string `json:"rule,omitempty"`
+	// Peers match alerts on peers as Rule.Peers; empty matches every peer.
+	Peers     []string  `json:"peers,omitempty"`
+	Comment   string    `json:"comment,omitempty"`
+	CreatedBy string    `json:"createdBy"`
+	CreatedAt time.Time `json:"createdAt"`
+	EndsAt    time.Time `json:"endsAt"`
+}
+
+// SilenceRequest creates a silence lasting Duration, such as "2h".
+type SilenceRequest struct {
+	Rule     string   `json:"rule,omitempty"`
+	Peers    []string `json:"peers,omitempty"`
+	Comment  string   `json:"comment,omitempty"`
+	Duration string   `json:"duration"`
+}
+
+func (s *Silence) matches(a *Alert, now time.Time) bool {
+	if !now.Before(s.EndsAt) {
+		return false
+	}
+	if s.Rule != "" && s.Rule != a.Rule {
+		return false
+	}
+	return len(s.Peers) == 0 || matchesPeer(s.Peers, a.Peer, a.IP, a.Tags)
+}
+
+// Silences are kept in a JSON file so they survive restarts.
+type Silences struct {
+	path string
+
+	mu       sync.Mutex
+	silences []*Silence
+}
+
+func loadSilences(path string) (*Silences, error) {
+	s := &Silences{path: path}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.silences); err != nil {
+		return nil, fmt.Errorf("invalid silences file %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// Add creates a silence from req for createdBy.
+func (s *Silences) Add(req SilenceRequest, createdBy string) (*Silence, error) {
+	d, err := time.ParseDuration(req.Duration)
+	if err != nil || d <= 0 {
+		return nil, fmt.Errorf("invalid duration %q", req.Duration)
+	}
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	silence := &Silence{
+		ID:        id,
+		Rule:      req.Rule,
+		Peers:     req.Peers,
+		Comment:   req.Comment,
+		CreatedBy: createdBy,
+		CreatedAt: now,
+		EndsAt:    now.Add(d),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expireLocked(now)
+	s.silences = append(s.silences, silence)
+	if err := s.saveLocked(); err != nil {
+		s.silences = s.silences[:len(s.silences)-1]
+		return nil, err
+	}
+	return silence, nil
+}
+
+// Delete ends the silence with id early.
+func (s *Silences) Delete(id string) (*Silence, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, silence := range s.silences {
+		if silence.ID == id {
+			s.silences = append(s.silences[:i], s.silences[i+1:]...)
+			return silence, s.saveLocked()
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// List returns the silences that haven't ended, ending soonest first.
+func (s *Silences) List() []Silence {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	silences := []Silence{}
+	for _, silence := range s.silences {
+		if now.Before(silence.EndsAt) {
+			silences = append(silences, *silence)
+		}
+	}
+	sort.Slice(silences, func(i, j int) bool {
+		return silences[i].EndsAt.Before(silences[j].EndsAt)
+	})
+	return silences
+}
+
+// match returns the ID of a silence matching a, or "".
+func (s *Silences) match(a *Alert, now time.Time) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, silence := range s.silences {
+		if silence.matches(a, now) {
+			return silence.ID
+		}
+	}
+	return ""
+}
+
+// expireLocked drops ended silences. They are only written out on the next
+// change, which is harmless as ended silences match nothing.
+func (s *Silences) expireLocked(now time.Time) {
+	kept := s.silences[:0]
+	for _, silence := range s.silences {
+		if now.Before(silence.EndsAt) {
+			kept = append(kept, silence)
+		}
+	}
+	s.silences = kept
+}
+
+func (s *Silences) saveLocked() error {
+	data, err := json.MarshalIndent(s.silences, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write silences: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write silences: %w", err)
+	}
+	return nil
+}
+
+func newID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,205 @@
+package api
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/rajsinghtech/tailtunnel/internal/canary"
+	"github.com/rajsinghtech/tailtunnel/internal/policy"
+	"github.com/rajsinghtech/tailtunnel/internal/ssh"
+	"github.com/rajsinghtech/tailtunnel/internal/tailscale"
+)
+
+// sessionGracePeriod reads how long a detached SSH session is kept alive
+// from SESSION_GRACE_PERIOD, e.g. "10m".
+func sessionGracePeriod() time.Duration {
+	if v := os.Getenv("SESSION_GRACE_PERIOD"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			return d
+		}
+		log.Printf("Invalid SESSION_GRACE_PERIOD %q, using default", v)
+	}
+	return 5 * time.Minute
+}
+
+// newConnectionPool returns the pool SSH sessions share connections
+// through, closing connections left idle for SSH_POOL_IDLE_TIMEOUT
+// (default 5m). Zero disables pooling, so every session dials its own.
+func newConnectionPool() *ssh.Pool {
+	idle := 5 * time.Minute
+	if v := os.Getenv("SSH_POOL_IDLE_TIMEOUT"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+			idle = d
+		} else {
+			log.Printf("Invalid SSH_POOL_IDLE_TIMEOUT %q, using default", v)
+		}
+	}
+	if idle == 0 {
+		return nil
+	}
+	return ssh.NewPool(idle)
+}
+
+// canaryConfig reads how often peers are pinged in the background from
+// CANARY_INTERVAL (default 1m, 0 disables it), which ping type is used from
+// CANARY_PING_TYPE (default disco), and how many days of downsampled
+// history to keep from CANARY_RETENTION_DAYS (default 30).
+func canaryConfig() (interval time.Duration, pingType canary.PingType, retention time.Duration) {
+	interval = time.Minute
+	if v := os.Getenv("CANARY_INTERVAL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+			interval = d
+		} else {
+			log.Printf("Invalid CANARY_INTERVAL %q, using default", v)
+		}
+	}
+
+	pingType, err := canary.ParsePingType(os.Getenv("CANARY_PING_TYPE"))
+	if err != nil {
+		log.Printf("Invalid CANARY_PING_TYPE: %v, using disco", err)
+		pingType = canary.PingDisco
+	}
+
+	days := 30
+	if v := os.Getenv("CANARY_RETENTION_DAYS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			days = n
+		} else {
+			log.Printf("Invalid CANARY_RETENTION_DAYS %q, using default", v)
+		}
+	}
+	return interval, pingType, time.Duration(days) * 24 * time.Hour
+}
+
+// alertFiles returns where alert rules are read from, ALERTS_FILE (default
+// $STATE_DIR/alerts.json), and where silences are kept.
+func alertFiles(ts *tailscale.TailscaleClient) (rules, silences string) {
+	rules = os.Getenv("ALERTS_FILE")
+	if rules == "" {
+		rules = filepath.Join(ts.StateDir(), "alerts.json")
+	}
+	return rules, filepath.Join(ts.StateDir(), "alert_silences.json")
+}
+
+// newPolicyEngine loads the SSH and TCP authorization policy from POLICY_FILE
+// (default $STATE_DIR/policy.json). The policy is enforced when the file
+// exists or SSH_POLICY=enforce; SSH_POLICY=open disables it.
+func newPolicyEngine(ts *tailscale.TailscaleClient) *policy.Engine {
+	path := os.Getenv("POLICY_FILE")
+	if path == "" {
+		path = filepath.Join(ts.StateDir(), "policy.json")
+	}
+
+	_, err := os.Stat(path)
+	enforce := err == nil
+	switch mode := os.Getenv("SSH_POLICY"); mode {
+	case "enforce":
+		enforce = true
+	case "open":
+		enforce = false
+	case "":
+	default:
+		log.Printf("Invalid SSH_POLICY %q, expected \"enforce\" or \"open\"", mode)
+	}
+
+	if enforce {
+		log.Printf("Enforcing policy from %s and %s/%s grants", path, policy.CapSSH, policy.CapTCP)
+	} else {
+		log.Printf("No SSH policy configured, all tailnet users may SSH or tunnel to any machine")
+	}
+
+	return policy.NewEngine(path, enforce, ts.FindMachine)
+}
+
+// auditRetention reads how many days of audit logs to keep from
+// AUDIT_RETENTION_DAYS. Zero keeps logs forever.
+func auditRetention() time.Duration {
+	days := 90
+	if v := os.Getenv("AUDIT_RETENTION_DAYS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			days = n
+		} else {
+			log.Printf("Invalid AUDIT_RETENTION_DAYS %q, using default", v)
+		}
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// recordingRetention reads how many days of SSH session recordings to keep
+// from RECORDING_RETENTION_DAYS. Zero keeps recordings forever.
+func recordingRetention() time.Duration {
+	days := 90
+	if v := os.Getenv("RECORDING_RETENTION_DAYS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			days = n
+		} else {
+			log.Printf("Invalid RECORDING_RETENTION_DAYS %q, using default", v)
+		}
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// vaultKeyFile returns where the key vault's master key is kept, from
+// VAULT_KEY_FILE (default $STATE_DIR/vault.key).
+func vaultKeyFile(ts *tailscale.TailscaleClient) string {
+	if path := os.Getenv("VAULT_KEY_FILE"); path != "" {
+		return path
+	}
+	return filepath.Join(ts.StateDir(), "vault.key")
+}
+
+// sshCAConfig reads whether TailTunnel signs short-lived certificates for
+// SSH logins from SSH_CA=true, where the CA key is kept from SSH_CA_KEY_FILE
+// (default $STATE_DIR/ssh_ca), and how long certificates are valid from
+// SSH_CA_CERT_TTL (default 5m).
+func sshCAConfig(ts *tailscale.TailscaleClient) (enabled bool, path string, ttl time.Duration) {
+	enabled = os.Getenv("SSH_CA") == "true"
+
+	path = os.Getenv("SSH_CA_KEY_FILE")
+	if path == "" {
+		path = filepath.Join(ts.StateDir(), "ssh_ca")
+	}
+
+	ttl = 5 * time.Minute
+	if v := os.Getenv("SSH_CA_CERT_TTL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			ttl = d
+		} else {
+			log.Printf("Invalid SSH_CA_CERT_TTL %q, using default", v)
+		}
+	}
+	return enabled, path, ttl
+}
+
+// sshGatewayConfig reads whether native ssh clients may connect through
+// TailTunnel from SSH_GATEWAY=true, and the tailnet port the gateway
+// listens on from SSH_GATEWAY_PORT (default 22).
+func sshGatewayConfig() (enabled bool, port int) {
+	enabled = os.Getenv("SSH_GATEWAY") == "true"
+
+	port = 22
+	if v := os.Getenv("SSH_GATEWAY_PORT"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 && n <= 65535 {
+			port = n
+		} else {
+			log.Printf("Invalid SSH_GATEWAY_PORT %q, using default", v)
+		}
+	}
+	return enabled, port
+}
+
+// proxyPort reads the tailnet port proxied peer web apps are served on from
+// PROXY_PORT (default 8443). It must differ from TailTunnel's own port so
+// the apps get an origin of their own.
+func proxyPort() int {
+	if v := os.Getenv("PROXY_PORT"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 && n <= 65535 && n != 80 && n != 443 {
+			return n
+		}
+		log.Printf("Invalid PROXY_PORT %q, using default", v)
+	}
+	return 8443
+}
@@ -1,31 +1,202 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/rajsinghtech/tailtunnel/internal/alert"
+	"github.com/rajsinghtech/tailtunnel/internal/audit"
 	"github.com/rajsinghtech/tailtunnel/internal/canary"
 	"github.com/rajsinghtech/tailtunnel/internal/diagnostics"
+	"github.com/rajsinghtech/tailtunnel/internal/files"
+	"github.com/rajsinghtech/tailtunnel/internal/fleet"
+	"github.com/rajsinghtech/tailtunnel/internal/forward"
+	"github.com/rajsinghtech/tailtunnel/internal/identity"
+	"github.com/rajsinghtech/tailtunnel/internal/metrics"
+	"github.com/rajsinghtech/tailtunnel/internal/policy"
+	"github.com/rajsinghtech/tailtunnel/internal/proxy"
+	"github.com/rajsinghtech/tailtunnel/internal/recording"
 	"github.com/rajsinghtech/tailtunnel/internal/ssh"
+	"github.com/rajsinghtech/tailtunnel/internal/sshca"
 	"github.com/rajsinghtech/tailtunnel/internal/tailscale"
+	"github.com/rajsinghtech/tailtunnel/internal/tunnel"
+	"github.com/rajsinghtech/tailtunnel/internal/vault"
 )
 
 type Handler struct {
-	ts            *tailscale.TailscaleClient
-	sshHandler    *ssh.SSHHandler
-	canaryHandler *canary.Handler
+	ts               *tailscale.TailscaleClient
+	audit            *audit.Logger
+	policy           *policy.Engine
+	sshHandler       *ssh.SSHHandler
+	tunnelHandler    *tunnel.Handler
+	proxyHandler     *proxy.Handler
+	proxyPort        int
+	forwardHandler   *forward.Handler
+	keysHandler      *vault.Handler
+	canaryHandler    *canary.Handler
+	recordingHandler *recording.Handler
+	auditHandler     *audit.Handler
+	fleetHandler     *fleet.Handler
+	filesHandler     *files.Handler
+	sshCA            *sshca.CA
+	metrics          *metrics.Metrics
+	alertHandler     *alert.Handler
 }
 
 func NewHandler(ts *tailscale.TailscaleClient) *Handler {
-	return &Handler{
-		ts: ts,
+	recordings := recording.NewStore(filepath.Join(ts.StateDir(), "recordings"), recordingRetention())
+	auditLog := audit.NewLogger(filepath.Join(ts.StateDir(), "audit"), auditRetention())
+	policyEngine := newPolicyEngine(ts)
+
+	h := &Handler{
+		ts:     ts,
+		audit:  auditLog,
+		policy: policyEngine,
 		sshHandler: &ssh.SSHHandler{
-			DialFunc: ts.DialSSH,
+			DialFunc:   ts.DialSSH,
+			Authorizer: policyEngine,
+			Audit:      auditLog,
+			Sessions:   ssh.NewRegistry(sessionGracePeriod()),
+			Pool:       newConnectionPool(),
+			HostKeys: &ssh.HostKeyVerifier{
+				LookupKeys:     ts.SSHHostKeys,
+				KnownHostsPath: filepath.Join(ts.StateDir(), "known_hosts"),
+			},
+		},
+		tunnelHandler: &tunnel.Handler{
+			Dial:       ts.Dial,
+			Authorizer: policyEngine,
+			Audit:      auditLog,
 		},
-		canaryHandler: canary.NewHandler(ts.LocalClient()),
+		proxyHandler:     proxy.NewHandler(ts.Dial, policyEngine),
+		proxyPort:        proxyPort(),
+		recordingHandler: recording.NewHandler(recordings, policyEngine.IsAuditor),
+		auditHandler:     audit.NewHandler(auditLog, policyEngine.IsAuditor),
+	}
+
+	pinger := canary.NewPinger(ts.LocalClient())
+	interval, pingType, canaryRetention := canaryConfig()
+	history := canary.NewStore(filepath.Join(ts.StateDir(), "canary"), canaryRetention)
+	pathEvents := canary.NewEvents(history)
+	h.canaryHandler = canary.NewHandler(pinger, history, pathEvents)
+	h.metrics = metrics.New(pinger, h.sshHandler)
+	alertRules, alertSilences := alertFiles(ts)
+	alerts, err := alert.NewEngine(alertRules, alertSilences)
+	if err != nil {
+		log.Fatalf("Failed to load alert silences: %v", err)
+	}
+	h.alertHandler = alert.NewHandler(alerts, auditLog)
+	if interval > 0 {
+		scheduler := canary.NewScheduler(pinger, history, interval, pingType)
+		scheduler.OnRound(h.metrics.ObserveRound)
+		scheduler.OnRound(pathEvents.Observe)
+		scheduler.OnRound(alerts.Observe)
+		go scheduler.Run(context.Background())
+	} else if rules, _ := alerts.Rules(); len(rules) > 0 {
+		log.Printf("WARNING: alert rules in %s are not evaluated because CANARY_INTERVAL is 0", alertRules)
+	}
+
+	runs := fleet.NewStore(filepath.Join(ts.StateDir(), "fleet"))
+	h.fleetHandler = fleet.NewHandler(fleet.NewRunner(h.sshHandler.Exec, ts.GetSSHMachines, runs, auditLog))
+	h.filesHandler = files.NewHandler(h.sshHandler.OpenSFTP, auditLog)
+	h.tunnelHandler.Forward = h.sshHandler.DialForward
+	whois := func(ctx context.Context, remoteAddr string) (*identity.Identity, error) {
+		return identity.WhoIs(ctx, ts.LocalClient(), remoteAddr)
+	}
+	h.forwardHandler = forward.NewHandler(forward.NewManager(
+		ts.Listen,
+		h.sshHandler.DialForward,
+		whois,
+		ts.SelfDNSName,
+		auditLog,
+	))
+
+	keys, err := vault.Open(filepath.Join(ts.StateDir(), "vault.json"), vaultKeyFile(ts), ts.FindMachine)
+	if err != nil {
+		log.Fatalf("Failed to open key vault: %v", err)
 	}
+	h.sshHandler.Credentials = keys
+	h.keysHandler = vault.NewHandler(keys, auditLog, policyEngine.IsAdmin)
+
+	if enabled, path, ttl := sshCAConfig(ts); enabled {
+		// Certificates are only as narrow as the policy behind them, and
+		// an open policy would hand every caller root on every host that
+		// trusts the CA.
+		if !policyEngine.Enforced() {
+			log.Fatalf("SSH_CA=true requires an enforced SSH policy; create a policy file or set SSH_POLICY=enforce")
+		}
+		ca, err := sshca.Load(path, ttl, policyEngine, auditLog)
+		if err != nil {
+			log.Fatalf("Failed to load SSH CA: %v", err)
+		}
+		log.Printf("Signing %s SSH certificates with CA %s", ttl, ca.PublicKey())
+		h.sshCA = ca
+		h.sshHandler.CA = ca
+	}
+
+	if os.Getenv("RECORD_SESSIONS") == "true" {
+		h.sshHandler.Recordings = recordings
+	}
+
+	if enabled, port := sshGatewayConfig(); enabled {
+		gateway, err := ssh.NewGateway(h.sshHandler, filepath.Join(ts.StateDir(), "ssh_gateway_host_key"), whois)
+		if err != nil {
+			log.Fatalf("Failed to start SSH gateway: %v", err)
+		}
+		ln, err := ts.Listen(port)
+		if err != nil {
+			log.Fatalf("Failed to listen for SSH gateway on port %d: %v", port, err)
+		}
+		go func() {
+			if err := gateway.Serve(ln); err != nil {
+				log.Printf("SSH gateway stopped: %v", err)
+			}
+		}()
+	}
+
+	return h
+}
+
+// ProxyPort returns the tailnet port NewProxyRouter should be served on.
+func (h *Handler) ProxyPort() int {
+	return h.proxyPort
+}
+
+// redirectToProxy sends /proxy/ links on TailTunnel's own origin to the
+// same path on the proxy port.
+func (h *Handler) redirectToProxy(w http.ResponseWriter, r *http.Request) {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	host := r.Host
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	target := url.URL{
+		Scheme:   scheme,
+		Host:     net.JoinHostPort(host, strconv.Itoa(h.proxyPort)),
+		Path:     r.URL.Path,
+		RawPath:  r.URL.RawPath,
+		RawQuery: r.URL.RawQuery,
+	}
+	http.Redirect(w, r, target.String(), http.StatusTemporaryRedirect)
+}
+
+// GetMe returns the tailnet identity of the caller.
+func (h *Handler) GetMe(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(identity.FromContext(r.Context()))
 }
 
 func (h *Handler) GetMachines(w http.ResponseWriter, r *http.Request) {
@@ -55,6 +226,115 @@ func (h *Handler) SSHWebSocket(w http.ResponseWriter, r *http.Request) {
 	h.sshHandler.HandleWebSocket(w, r, machine, user)
 }
 
+// SSHCAPublicKey serves the CA public key for hosts to list in
+// TrustedUserCAKeys.
+func (h *Handler) SSHCAPublicKey(w http.ResponseWriter, r *http.Request) {
+	if h.sshCA == nil {
+		http.Error(w, "SSH CA is not enabled", http.StatusNotFound)
+		return
+	}
+	h.sshCA.ServePublicKey(w, r)
+}
+
+// GetSSHConnections lists the caller's pooled SSH connections.
+func (h *Handler) GetSSHConnections(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.sshHandler.Connections(r.Context()))
+}
+
+type sessionViewersResponse struct {
+	ssh.Sharing
+	Participants []ssh.Participant `json:"participants"`
+}
+
+func (h *Handler) TCPWebSocket(w http.ResponseWriter, r *http.Request) {
+	h.tunnelHandler.HandleWebSocket(w, r, chi.URLParam(r, "machine"), chi.URLParam(r, "port"))
+}
+
+func (h *Handler) ForwardWebSocket(w http.ResponseWriter, r *http.Request) {
+	h.tunnelHandler.HandleForward(w, r, chi.URLParam(r, "machine"))
+}
+
+func (h *Handler) Exec(w http.ResponseWriter, r *http.Request) {
+	machine := chi.URLParam(r, "machine")
+	if machine == "" {
+		http.Error(w, "machine parameter required", http.StatusBadRequest)
+		return
+	}
+
+	h.sshHandler.HandleExec(w, r, machine)
+}
+
+func (h *Handler) GetSessionViewers(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.ownedSession(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessionViewersResponse{
+		Sharing:      session.Sharing(),
+		Participants: session.Participants(),
+	})
+}
+
+func (h *Handler) RevokeSessionViewer(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.ownedSession(w, r)
+	if !ok {
+		return
+	}
+
+	viewer := chi.URLParam(r, "viewer")
+	if !session.Revoke(viewer) {
+		http.Error(w, "viewer not found", http.StatusNotFound)
+		return
+	}
+
+	ev := audit.NewEvent(r.Context(), audit.ActionViewerRevoked)
+	ev.Machine = session.Machine
+	ev.RemoteUser = session.User
+	ev.SessionID = session.ID
+	ev.Details = map[string]any{"viewer": viewer}
+	h.audit.Log(ev)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// UpdateSessionSharing replaces the session's sharing settings with the
+// JSON-encoded ssh.Sharing in the body.
+func (h *Handler) UpdateSessionSharing(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.ownedSession(w, r)
+	if !ok {
+		return
+	}
+
+	var req ssh.Sharing
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	session.SetSharing(req)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ownedSession looks up the session named in the URL and checks that the
+// caller started it. Only the owner may see or manage who is watching.
+func (h *Handler) ownedSession(w http.ResponseWriter, r *http.Request) (*ssh.Session, bool) {
+	session, ok := h.sshHandler.Sessions.Get(chi.URLParam(r, "id"))
+	if !ok {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return nil, false
+	}
+
+	if session.Identity != identity.OwnerName(r.Context()) {
+		http.Error(w, "only the session owner can manage viewers", http.StatusForbidden)
+		return nil, false
+	}
+
+	return session, true
+}
+
 func (h *Handler) GetDiagnostics(w http.ResponseWriter, r *http.Request) {
 	diag, err := diagnostics.GetDiagnostics(r.Context(), h.ts.LocalClient())
 	if err != nil {
@@ -66,3 +346,25 @@ func (h *Handler) GetDiagnostics(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(diag)
 }
+
+// audited wraps next so that every call is recorded in the audit log as
+// action, along with the response status.
+func (h *Handler) audited(action string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next(ww, r)
+
+		ev := audit.NewEvent(r.Context(), action)
+		if ww.Status() >= http.StatusBadRequest {
+			ev.Outcome = audit.OutcomeFailure
+			ev.Reason = http.StatusText(ww.Status())
+		}
+		ev.Details = map[string]any{
+			"path":       r.URL.Path,
+			"status":     ww.Status(),
+			"durationMs": time.Since(start).Milliseconds(),
+		}
+		h.audit.Log(ev)
+	}
+}
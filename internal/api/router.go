@@ -10,6 +10,8 @@ import (
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+	"github.com/rajsinghtech/tailtunnel/internal/audit"
+	"github.com/rajsinghtech/tailtunnel/internal/identity"
 )
 
 func NewRouter(h *Handler, frontendFS embed.FS) http.Handler {
@@ -17,20 +19,94 @@ func NewRouter(h *Handler, frontendFS embed.FS) http.Handler {
 
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
+	r.Use(h.metrics.Middleware)
 	r.Use(middleware.Compress(5))
 
 	r.Route("/api", func(r chi.Router) {
+		r.Use(identity.RequireSameOrigin)
+		r.Use(identity.Middleware(h.ts.LocalClient()))
+		r.Use(audit.Middleware(h.audit))
+
+		r.Get("/me", h.GetMe)
 		r.Get("/machines", h.GetMachines)
 		r.Get("/ws/ssh/{machine}", h.SSHWebSocket)
-		r.Get("/diagnostics", h.GetDiagnostics)
+		r.Get("/ws/tcp/{machine}/{port}", h.TCPWebSocket)
+		r.Get("/ws/forward/{machine}", h.ForwardWebSocket)
+		r.Post("/exec/{machine}", h.Exec)
+		r.Get("/ssh/ca.pub", h.SSHCAPublicKey)
+		r.Get("/ssh/connections", h.GetSSHConnections)
+		r.Get("/diagnostics", h.audited(audit.ActionDiagnostics, h.GetDiagnostics))
+		r.Get("/audit", h.audited(audit.ActionAuditQuery, h.auditHandler.Query))
+
+		r.Route("/sessions/{id}", func(r chi.Router) {
+			r.Get("/viewers", h.GetSessionViewers)
+			r.Delete("/viewers/{viewer}", h.RevokeSessionViewer)
+			r.Put("/sharing", h.UpdateSessionSharing)
+		})
 
 		r.Route("/canary", func(r chi.Router) {
 			r.Get("/peers", h.canaryHandler.GetPeers)
 			r.Post("/ping", h.canaryHandler.Ping)
-			r.Post("/ping-all", h.canaryHandler.PingAll)
+			r.Post("/ping-all", h.audited(audit.ActionCanaryPingAll, h.canaryHandler.PingAll))
+			r.Get("/history", h.canaryHandler.History)
+			r.Get("/events", h.canaryHandler.Events)
+			r.Get("/events/stream", h.canaryHandler.EventStream)
+		})
+
+		r.Route("/alerts", func(r chi.Router) {
+			r.Get("/", h.alertHandler.List)
+			r.Get("/rules", h.alertHandler.Rules)
+			r.Get("/silences", h.alertHandler.ListSilences)
+
+			r.Group(func(r chi.Router) {
+				r.Use(h.policy.RequireAdmin)
+				r.Post("/silences", h.alertHandler.CreateSilence)
+				r.Delete("/silences/{id}", h.alertHandler.DeleteSilence)
+				r.Post("/receivers/{name}/test", h.audited(audit.ActionAlertTest, h.alertHandler.TestReceiver))
+			})
+		})
+
+		r.Route("/files/{machine}", func(r chi.Router) {
+			r.Get("/list", h.filesHandler.List)
+			r.Get("/stat", h.filesHandler.Stat)
+			r.Get("/download", h.filesHandler.Download)
+			r.Post("/upload", h.filesHandler.Upload)
+			r.Post("/mkdir", h.filesHandler.Mkdir)
+			r.Post("/rename", h.filesHandler.Rename)
+			r.Delete("/", h.filesHandler.Delete)
+		})
+
+		r.Route("/forwards", func(r chi.Router) {
+			r.Get("/", h.forwardHandler.List)
+			r.Post("/", h.forwardHandler.Create)
+			r.Delete("/{id}", h.forwardHandler.Close)
+		})
+
+		r.Route("/keys", func(r chi.Router) {
+			r.Get("/", h.keysHandler.List)
+			r.Post("/", h.keysHandler.Create)
+			r.Put("/{id}", h.keysHandler.Update)
+			r.Delete("/{id}", h.keysHandler.Delete)
+		})
+
+		r.Route("/fleet/runs", func(r chi.Router) {
+			r.Get("/", h.fleetHandler.List)
+			r.Post("/", h.fleetHandler.Create)
+			r.Get("/{id}", h.fleetHandler.Get)
+			r.Get("/{id}/events", h.fleetHandler.Events)
+		})
+
+		r.Route("/recordings", func(r chi.Router) {
+			r.Get("/", h.recordingHandler.List)
+			r.Get("/{id}", h.audited(audit.ActionRecordingRead, h.recordingHandler.Download))
+			r.Get("/{id}/stream", h.audited(audit.ActionRecordingRead, h.recordingHandler.Stream))
 		})
 	})
 
+	r.HandleFunc("/proxy/*", h.redirectToProxy)
+
+	r.With(identity.Middleware(h.ts.LocalClient())).Handle("/metrics", h.metrics.Handler())
+
 	frontendDist, err := fs.Sub(frontendFS, "frontend/dist")
 	if err != nil {
 		panic(err)
@@ -89,3 +165,24 @@ func NewRouter(h *Handler, frontendFS embed.FS) http.Handler {
 
 	return r
 }
+
+// NewProxyRouter serves peer web apps under /proxy/{machine}/{port}/. It is
+// served on its own port so the apps get an origin apart from TailTunnel's
+// pages and API.
+func NewProxyRouter(h *Handler) http.Handler {
+	r := chi.NewRouter()
+
+	r.Use(middleware.Logger)
+	r.Use(middleware.Recoverer)
+	r.Use(h.metrics.Middleware)
+
+	r.Route("/proxy/{machine}/{port}", func(r chi.Router) {
+		r.Use(identity.Middleware(h.ts.LocalClient()))
+		r.Use(audit.Middleware(h.audit))
+
+		r.HandleFunc("/", h.proxyHandler.Proxy)
+		r.HandleFunc("/*", h.proxyHandler.Proxy)
+	})
+
+	return r
+}
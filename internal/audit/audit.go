@@ -0,0 +1,358 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Actions recorded in the audit log.
+const (
+	ActionSSHStart       = "ssh.session.start"
+	ActionSSHEnd         = "ssh.session.end"
+	ActionSSHJoin        = "ssh.session.join"
+	ActionSSHDenied      = "ssh.denied"
+	ActionSSHExec        = "ssh.exec"
+	ActionCertIssued     = "ssh.cert.issue"
+	ActionViewerRevoked  = "ssh.viewer.revoke"
+	ActionTCPTunnel      = "tcp.tunnel"
+	ActionForwardCreate  = "forward.create"
+	ActionForwardClose   = "forward.close"
+	ActionForwardConnect = "forward.connect"
+	ActionKeyChange      = "keys.change"
+	ActionFleetRun       = "fleet.run"
+	ActionFileRead       = "files.read"
+	ActionFileWrite      = "files.write"
+	ActionCanaryPingAll  = "canary.ping_all"
+	ActionAlertSilence   = "alert.silence"
+	ActionAlertTest      = "alert.test"
+	ActionDiagnostics    = "diagnostics.view"
+	ActionRequestDenied  = "http.denied"
+	ActionRecordingRead  = "recording.read"
+	ActionAuditQuery     = "audit.query"
+)
+
+// Outcomes of an audited action.
+const (
+	OutcomeSuccess = "success"
+	OutcomeDenied  = "denied"
+	OutcomeFailure = "failure"
+)
+
+const (
+	maxFileSize  = 50 * 1024 * 1024
+	filePrefix   = "audit-"
+	fileExt      = ".jsonl"
+	dayLayout    = "2006-01-02"
+	defaultLimit = 500
+	maxLimit     = 5000
+)
+
+// Event is a single audit log entry.
+type Event struct {
+	Time       time.Time      `json:"time"`
+	Action     string         `json:"action"`
+	Outcome    string         `json:"outcome"`
+	User       string         `json:"user,omitempty"`
+	Node       string         `json:"node,omitempty"`
+	Machine    string         `json:"machine,omitempty"`
+	RemoteUser string         `json:"remoteUser,omitempty"`
+	SessionID  string         `json:"sessionId,omitempty"`
+	Reason     string         `json:"reason,omitempty"`
+	Details    map[string]any `json:"details,omitempty"`
+}
+
+// Logger appends events as JSON lines to daily files, starting a new file
+// when the current one grows too large, and deletes files older than the
+// retention period. A nil *Logger discards events.
+type Logger struct {
+	dir       string
+	retention time.Duration
+
+	mu   sync.Mutex
+	f    *os.File
+	day  string
+	seq  int
+	size int64
+}
+
+func NewLogger(dir string, retention time.Duration) *Logger {
+	l := &Logger{dir: dir, retention: retention}
+	l.prune(time.Now())
+	return l
+}
+
+// Log appends ev, filling in the time if unset.
+func (l *Logger) Log(ev Event) {
+	if l == nil {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	if ev.Outcome == "" {
+		ev.Outcome = OutcomeSuccess
+	}
+
+	line, err := json.Marshal(ev)
+	if err != nil {
+		log.Printf("Failed to encode audit event: %v", err)
+		return
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.rotate(ev.Time, int64(len(line))); err != nil {
+		log.Printf("Failed to open audit log: %v", err)
+		return
+	}
+
+	n, err := l.f.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		log.Printf("Failed to write audit event: %v", err)
+	}
+}
+
+// rotate makes sure l.f is open and has room for n more bytes.
+func (l *Logger) rotate(now time.Time, n int64) error {
+	day := now.UTC().Format(dayLayout)
+	if l.f != nil && l.day == day && l.size+n <= maxFileSize {
+		return nil
+	}
+
+	if l.f != nil {
+		l.f.Close()
+		l.f = nil
+	}
+
+	if err := os.MkdirAll(l.dir, 0700); err != nil {
+		return err
+	}
+
+	if l.day != day {
+		l.day = day
+		l.seq = 0
+		l.prune(now)
+	}
+
+	for {
+		f, err := os.OpenFile(l.path(l.day, l.seq), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		stat, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		if stat.Size()+n <= maxFileSize || stat.Size() == 0 {
+			l.f = f
+			l.size = stat.Size()
+			return nil
+		}
+		f.Close()
+		l.seq++
+	}
+}
+
+func (l *Logger) path(day string, seq int) string {
+	name := filePrefix + day
+	if seq > 0 {
+		name += fmt.Sprintf(".%d", seq)
+	}
+	return filepath.Join(l.dir, name+fileExt)
+}
+
+// prune deletes files from days that fall outside the retention period.
+func (l *Logger) prune(now time.Time) {
+	if l.retention <= 0 {
+		return
+	}
+	cutoff := now.Add(-l.retention).UTC().Format(dayLayout)
+
+	files, err := l.files()
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		if f.day < cutoff {
+			if err := os.Remove(filepath.Join(l.dir, f.name)); err == nil {
+				log.Printf("Removed expired audit log %s", f.name)
+			}
+		}
+	}
+}
+
+type logFile struct {
+	name string
+	day  string
+	seq  int
+}
+
+func (l *Logger) files() ([]logFile, error) {
+	entries, err := os.ReadDir(l.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var files []logFile
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, filePrefix) || !strings.HasSuffix(name, fileExt) {
+			continue
+		}
+		day := strings.TrimSuffix(strings.TrimPrefix(name, filePrefix), fileExt)
+		day, suffix, _ := strings.Cut(day, ".")
+		if _, err := time.Parse(dayLayout, day); err != nil {
+			continue
+		}
+		seq, _ := strconv.Atoi(suffix)
+		files = append(files, logFile{name: name, day: day, seq: seq})
+	}
+
+	// Newest first, as each file continues where the one before it ended.
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].day != files[j].day {
+			return files[i].day > files[j].day
+		}
+		return files[i].seq > files[j].seq
+	})
+	return files, nil
+}
+
+// Query selects events from the log. Empty fields match everything.
+type Query struct {
+	User    string
+	Node    string
+	Machine string
+	Action  string
+	Since   time.Time
+	Until   time.Time
+	Limit   int
+}
+
+func (q Query) matches(ev *Event) bool {
+	if q.User != "" && !strings.EqualFold(ev.User, q.User) {
+		return false
+	}
+	if q.Node != "" && !strings.EqualFold(ev.Node, q.Node) {
+		return false
+	}
+	if q.Machine != "" && !strings.EqualFold(strings.TrimSuffix(ev.Machine, "."), strings.TrimSuffix(q.Machine, ".")) {
+		return false
+	}
+	if q.Action != "" && ev.Action != q.Action && !strings.HasPrefix(ev.Action, q.Action+".") {
+		return false
+	}
+	if !q.Since.IsZero() && ev.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && ev.Time.After(q.Until) {
+		return false
+	}
+	return true
+}
+
+// Query returns matching events, newest first, up to q.Limit. Files are
+// read newest first, stopping once enough events are found.
+func (l *Logger) Query(q Query) ([]Event, error) {
+	if q.Limit <= 0 {
+		q.Limit = defaultLimit
+	}
+	q.Limit = min(q.Limit, maxLimit)
+
+	files, err := l.files()
+	if err != nil {
+		return nil, err
+	}
+
+	var sinceDay, untilDay string
+	if !q.Since.IsZero() {
+		sinceDay = q.Since.UTC().Format(dayLayout)
+	}
+	if !q.Until.IsZero() {
+		untilDay = q.Until.UTC().Format(dayLayout)
+	}
+
+	events := []Event{}
+	for _, f := range files {
+		if (sinceDay != "" && f.day < sinceDay) || (untilDay != "" && f.day > untilDay) {
+			continue
+		}
+		found, err := readEvents(filepath.Join(l.dir, f.name), q, q.Limit-len(events))
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, found...)
+		if len(events) >= q.Limit {
+			break
+		}
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Time.After(events[j].Time)
+	})
+	if len(events) > q.Limit {
+		events = events[:q.Limit]
+	}
+	return events, nil
+}
+
+// readEvents returns the last n events in the file at path that match q.
+func readEvents(path string, q Query, n int) ([]Event, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var events []Event
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var ev Event
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			continue
+		}
+		if !q.matches(&ev) {
+			continue
+		}
+		events = append(events, ev)
+		if len(events) >= 2*n {
+			events = append(events[:0], events[n:]...)
+		}
+	}
+	if len(events) > n {
+		events = events[len(events)-n:]
+	}
+	return events, scanner.Err()
+}
+
+// Close closes the current log file.
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
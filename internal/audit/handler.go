@@ -0,0 +1,117 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/rajsinghtech/tailtunnel/internal/identity"
+)
+
+// NewEvent returns an event for action attributed to the caller in ctx.
+func NewEvent(ctx context.Context, action string) Event {
+	ev := Event{Time: time.Now(), Action: action}
+	if id := identity.FromContext(ctx); id != nil {
+		ev.User = id.LoginName
+		ev.Node = id.NodeName
+	}
+	return ev
+}
+
+// Middleware records every request that is answered with 401 or 403. It
+// must run after identity.Middleware so denials are attributed.
+func Middleware(l *Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			next.ServeHTTP(ww, r)
+
+			if status := ww.Status(); status == http.StatusUnauthorized || status == http.StatusForbidden {
+				ev := NewEvent(r.Context(), ActionRequestDenied)
+				ev.Outcome = OutcomeDenied
+				ev.Reason = fmt.Sprintf("%s %s returned %d", r.Method, r.URL.Path, status)
+				l.Log(ev)
+			}
+		})
+	}
+}
+
+type Handler struct {
+	logger    *Logger
+	isAuditor func(*identity.Identity) bool
+}
+
+// NewHandler returns a handler that lets callers isAuditor approves query
+// every event, and everyone else only their own.
+func NewHandler(logger *Logger, isAuditor func(*identity.Identity) bool) *Handler {
+	return &Handler{logger: logger, isAuditor: isAuditor}
+}
+
+// Query returns audit events filtered by the user, node, machine, action,
+// since, until (RFC 3339) and limit query parameters.
+func (h *Handler) Query(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	q := Query{
+		User:    params.Get("user"),
+		Node:    params.Get("node"),
+		Machine: params.Get("machine"),
+		Action:  params.Get("action"),
+	}
+	if caller := identity.FromContext(r.Context()); !h.isAuditor(caller) {
+		// Tagged nodes share a login name, so they only see their own
+		// node's events.
+		var node string
+		if caller != nil && caller.IsTagged() {
+			node = caller.NodeName
+		}
+		if caller == nil || caller.LoginName == "" ||
+			(q.User != "" && !strings.EqualFold(q.User, caller.LoginName)) ||
+			(node != "" && q.Node != "" && !strings.EqualFold(q.Node, node)) {
+			http.Error(w, "Only auditors may see other users' events", http.StatusForbidden)
+			return
+		}
+		q.User = caller.LoginName
+		if node != "" {
+			q.Node = node
+		}
+	}
+
+	var err error
+	if q.Since, err = parseTime(params.Get("since")); err != nil {
+		http.Error(w, "invalid since: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if q.Until, err = parseTime(params.Get("until")); err != nil {
+		http.Error(w, "invalid until: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if v := params.Get("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	events, err := h.logger.Query(q)
+	if err != nil {
+		log.Printf("Failed to query audit log: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
@@ -0,0 +1,255 @@
+package canary
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// maxRecentEvents is how many events are kept in memory for followers
+	// that fall behind.
+	maxRecentEvents = 256
+
+	defaultEventLimit = 500
+	maxEventLimit     = 5000
+)
+
+// PathState is the path traffic to a peer takes.
+type PathState struct {
+	ConnectionType ConnectionType `json:"connectionType"`
+	Endpoint       string         `json:"endpoint,omitempty"`
+	DERPRegion     string         `json:"derpRegion,omitempty"`
+	PeerRelay      string         `json:"peerRelay,omitempty"`
+}
+
+func (s PathState) changes(o PathState) []string {
+	var changed []string
+	if s.ConnectionType != o.ConnectionType {
+		changed = append(changed, "connectionType")
+	}
+	if s.Endpoint != o.Endpoint {
+		changed = append(changed, "endpoint")
+	}
+	if s.DERPRegion != o.DERPRegion {
+		changed = append(changed, "derpRegion")
+	}
+	if s.PeerRelay != o.PeerRelay {
+		changed = append(changed, "peerRelay")
+	}
+	return changed
+}
+
+// PathEvent records a change in the path to a peer, such as a fall back
+// from a direct connection to DERP or a move to another DERP region.
+type PathEvent struct {
+	Time    time.Time `json:"time"`
+	Peer    string    `json:"peer"`
+	IP      string    `json:"ip"`
+	Before  PathState `json:"before"`
+	After   PathState `json:"after"`
+	Changed []string  `json:"changed"`
+}
+
+// Events detects path changes from scheduled ping rounds, records them in
+// the Store and passes them on to live followers.
+type Events struct {
+	store *Store
+
+	mu   sync.Mutex
+	last map[string]PathState // by peer IP
+	// recent holds the latest events; total counts every event so far, so
+	// recent[0] is event number total-len(recent).
+	recent  []PathEvent
+	total   int
+	changed chan struct{}
+}
+
+func NewEvents(store *Store) *Events {
+	return &Events{
+		store:   store,
+		last:    make(map[string]PathState),
+		changed: make(chan struct{}),
+	}
+}
+
+// Observe compares a round's results with each peer's last known path. It
+// is registered with Scheduler.OnRound. A peer's first result only sets its
+// path, and a failed ping of an online peer is ignored, as it says nothing
+// about the path.
+func (e *Events) Observe(round Round) {
+	var events []PathEvent
+
+	e.mu.Lock()
+	seen := make(map[string]bool, len(round.Samples))
+	for _, sample := range round.Samples {
+		seen[sample.IP] = true
+		if !sample.Success && sample.ConnectionType != ConnectionOffline {
+			continue
+		}
+		state := PathState{
+			ConnectionType: sample.ConnectionType,
+			Endpoint:       sample.Endpoint,
+			DERPRegion:     sample.DERPRegion,
+			PeerRelay:      sample.PeerRelay,
+		}
+
+		before, ok := e.last[sample.IP]
+		e.last[sample.IP] = state
+		if !ok {
+			continue
+		}
+		if changed := before.changes(state); len(changed) > 0 {
+			events = append(events, PathEvent{
+				Time:    sample.Time,
+				Peer:    sample.Peer,
+				IP:      sample.IP,
+				Before:  before,
+				After:   state,
+				Changed: changed,
+			})
+		}
+	}
+
+	// Forget peers that have left the tailnet.
+	for ip := range e.last {
+		if !seen[ip] {
+			delete(e.last, ip)
+		}
+	}
+
+	if len(events) > 0 {
+		e.recent = append(e.recent, events...)
+		if n := len(e.recent) - maxRecentEvents; n > 0 {
+			e.recent = append([]PathEvent(nil), e.recent[n:]...)
+		}
+		e.total += len(events)
+		close(e.changed)
+		e.changed = make(chan struct{})
+	}
+	e.mu.Unlock()
+
+	for _, ev := range events {
+		log.Printf("Canary: path to %s changed from %s to %s", ev.Peer, describePath(ev.Before), describePath(ev.After))
+	}
+	if err := e.store.AddEvents(events); err != nil {
+		log.Printf("Canary: failed to record path events: %v", err)
+	}
+}
+
+func describePath(s PathState) string {
+	switch {
+	case s.Endpoint != "":
+		return fmt.Sprintf("%s (%s)", s.ConnectionType, s.Endpoint)
+	case s.PeerRelay != "":
+		return fmt.Sprintf("%s (%s)", s.ConnectionType, s.PeerRelay)
+	case s.DERPRegion != "":
+		return fmt.Sprintf("%s (%s)", s.ConnectionType, s.DERPRegion)
+	}
+	return string(s.ConnectionType)
+}
+
+// Follow calls fn for every event from now on until ctx is canceled. A
+// follower too slow to keep up misses the events that dropped out of
+// memory.
+func (e *Events) Follow(ctx context.Context, fn func(PathEvent)) error {
+	e.mu.Lock()
+	sent := e.total
+	e.mu.Unlock()
+
+	for {
+		e.mu.Lock()
+		first := e.total - len(e.recent)
+		pending := e.recent[max(sent-first, 0):]
+		sent = e.total
+		changed := e.changed
+		e.mu.Unlock()
+
+		for _, ev := range pending {
+			fn(ev)
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// AddEvents records path events.
+func (s *Store) AddEvents(events []PathEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return err
+	}
+	lines := make(map[string][]any)
+	for _, ev := range events {
+		path := s.path(eventsPrefix, ev.Time)
+		lines[path] = append(lines[path], ev)
+	}
+	for path, records := range lines {
+		if err := appendLines(path, records); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EventQuery selects path events. An empty Peer matches every peer.
+type EventQuery struct {
+	Peer  string
+	From  time.Time
+	To    time.Time
+	Limit int
+}
+
+// QueryEvents returns the path events between From and To, oldest first.
+// If there are more than Limit, the latest are returned.
+func (s *Store) QueryEvents(q EventQuery) ([]PathEvent, error) {
+	if !q.From.Before(q.To) {
+		return nil, fmt.Errorf("from must be before to")
+	}
+	if q.Limit <= 0 || q.Limit > maxEventLimit {
+		return nil, fmt.Errorf("limit must be between 1 and %d", maxEventLimit)
+	}
+
+	events := []PathEvent{}
+	for day := q.From.UTC().Truncate(24 * time.Hour); day.Before(q.To); day = day.Add(24 * time.Hour) {
+		err := readLines(s.path(eventsPrefix, day), func(line []byte) {
+			var ev PathEvent
+			if json.Unmarshal(line, &ev) != nil {
+				return
+			}
+			if ev.Time.Before(q.From) || !ev.Time.Before(q.To) {
+				return
+			}
+			if q.Peer != "" && !matchesPeer(ev.Peer, ev.IP, q.Peer) {
+				return
+			}
+			events = append(events, ev)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Time.Before(events[j].Time)
+	})
+	if len(events) > q.Limit {
+		events = events[len(events)-q.Limit:]
+	}
+	return events, nil
+}
@@ -2,19 +2,30 @@ package canary
 
 import (
 	"encoding/json"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"strconv"
+	"time"
+)
 
-	"tailscale.com/client/tailscale"
+const (
+	defaultHistoryRange  = 24 * time.Hour
+	defaultHistoryPoints = 300
 )
 
 type Handler struct {
-	pinger *Pinger
+	pinger  *Pinger
+	history *Store
+	events  *Events
 }
 
-func NewHandler(lc *tailscale.LocalClient) *Handler {
+func NewHandler(pinger *Pinger, history *Store, events *Events) *Handler {
 	return &Handler{
-		pinger: NewPinger(lc),
+		pinger:  pinger,
+		history: history,
+		events:  events,
 	}
 }
 
@@ -42,7 +53,13 @@ func (h *Handler) Ping(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	result, err := h.pinger.Ping(r.Context(), req.IP)
+	pingType, err := ParsePingType(req.Type)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := h.pinger.Ping(r.Context(), req.IP, pingType)
 	if err != nil {
 		log.Printf("Failed to ping %s: %v", req.IP, err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -53,8 +70,16 @@ func (h *Handler) Ping(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(result)
 }
 
+// PingAll pings every online peer. The "type" query parameter selects the
+// ping type, as in PingRequest.
 func (h *Handler) PingAll(w http.ResponseWriter, r *http.Request) {
-	results, err := h.pinger.PingAll(r.Context())
+	pingType, err := ParsePingType(r.URL.Query().Get("type"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	results, err := h.pinger.PingAll(r.Context(), pingType)
 	if err != nil {
 		log.Printf("Failed to ping all: %v", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -64,3 +89,119 @@ func (h *Handler) PingAll(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(results)
 }
+
+// History returns a peer's ping history. from and to are RFC 3339 times or
+// durations before now, such as "12h", and default to the last day; step
+// is a duration and defaults to about 300 points over the range.
+func (h *Handler) History(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	q := HistoryQuery{Peer: params.Get("peer")}
+	if q.Peer == "" {
+		http.Error(w, "peer parameter required", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	var err error
+	if q.To, err = parseTime(params.Get("to"), now, now); err != nil {
+		http.Error(w, "invalid to: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if q.From, err = parseTime(params.Get("from"), now, q.To.Add(-defaultHistoryRange)); err != nil {
+		http.Error(w, "invalid from: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	q.Step = max(q.To.Sub(q.From)/defaultHistoryPoints, time.Minute).Round(time.Minute)
+	if v := params.Get("step"); v != "" {
+		if q.Step, err = time.ParseDuration(v); err != nil {
+			http.Error(w, "invalid step", http.StatusBadRequest)
+			return
+		}
+	}
+
+	history, err := h.history.Query(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(history)
+}
+
+// Events returns the timeline of path changes. peer optionally selects one
+// peer; from and to are as for History; limit caps the number of events,
+// keeping the latest.
+func (h *Handler) Events(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	q := EventQuery{Peer: params.Get("peer"), Limit: defaultEventLimit}
+
+	now := time.Now()
+	var err error
+	if q.To, err = parseTime(params.Get("to"), now, now); err != nil {
+		http.Error(w, "invalid to: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if q.From, err = parseTime(params.Get("from"), now, q.To.Add(-defaultHistoryRange)); err != nil {
+		http.Error(w, "invalid from: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if v := params.Get("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	events, err := h.history.QueryEvents(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"events": events})
+}
+
+// EventStream streams path changes as server-sent "path" events as they
+// happen, optionally only those of the peer given by the peer parameter.
+func (h *Handler) EventStream(w http.ResponseWriter, r *http.Request) {
+	peer := r.URL.Query().Get("peer")
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	h.events.Follow(r.Context(), func(ev PathEvent) {
+		if peer != "" && !matchesPeer(ev.Peer, ev.IP, peer) {
+			return
+		}
+		writeSSE(w, "path", ev)
+		flusher.Flush()
+	})
+}
+
+func writeSSE(w io.Writer, event string, v any) {
+	data, _ := json.Marshal(v)
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+}
+
+// parseTime parses an RFC 3339 time or a duration before now, returning def
+// for an empty string.
+func parseTime(s string, now, def time.Time) (time.Time, error) {
+	if s == "" {
+		return def, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d.Abs()), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
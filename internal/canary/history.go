@@ -0,0 +1,395 @@
+package canary
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// rollupInterval is the resolution history is kept at once raw samples
+	// expire.
+	rollupInterval = 5 * time.Minute
+	rawRetention   = 48 * time.Hour
+
+	// maxHistoryPoints bounds the number of buckets a query may ask for.
+	maxHistoryPoints = 5000
+
+	rawPrefix    = "raw-"
+	rollupPrefix = "5m-"
+	eventsPrefix = "events-"
+	historyExt   = ".jsonl"
+	dayLayout    = "2006-01-02"
+)
+
+// Sample is the outcome of one scheduled ping of a peer.
+type Sample struct {
+	Time           time.Time      `json:"time"`
+	Peer           string         `json:"peer"`
+	IP             string         `json:"ip"`
+	Success        bool           `json:"success"`
+	LatencyMs      float64        `json:"latencyMs,omitempty"`
+	ConnectionType ConnectionType `json:"connectionType"`
+	Endpoint       string         `json:"endpoint,omitempty"`
+	DERPRegion     string         `json:"derpRegion,omitempty"`
+	PeerRelay      string         `json:"peerRelay,omitempty"`
+	Error          string         `json:"error,omitempty"`
+}
+
+// Point summarizes the samples of a peer in one step of a history query.
+type Point struct {
+	Time            time.Time              `json:"time"`
+	Count           int                    `json:"count"`
+	Failures        int                    `json:"failures"`
+	LossPercent     float64                `json:"lossPercent"`
+	MinMs           float64                `json:"minMs,omitempty"`
+	AvgMs           float64                `json:"avgMs,omitempty"`
+	MaxMs           float64                `json:"maxMs,omitempty"`
+	ConnectionType  ConnectionType         `json:"connectionType,omitempty"`
+	ConnectionTypes map[ConnectionType]int `json:"connectionTypes,omitempty"`
+}
+
+// HistoryResponse is a peer's connectivity over a time range.
+type HistoryResponse struct {
+	Peer   string    `json:"peer"`
+	From   time.Time `json:"from"`
+	To     time.Time `json:"to"`
+	Step   string    `json:"step"`
+	Points []Point   `json:"points"`
+}
+
+// rollup aggregates samples. It is both the on-disk downsampled record and
+// the accumulator for query buckets.
+type rollup struct {
+	Time            time.Time              `json:"time"`
+	Peer            string                 `json:"peer"`
+	IP              string                 `json:"ip"`
+	Count           int                    `json:"count"`
+	Failures        int                    `json:"failures"`
+	SumMs           float64                `json:"sumMs"`
+	MinMs           float64                `json:"minMs"`
+	MaxMs           float64                `json:"maxMs"`
+	ConnectionTypes map[ConnectionType]int `json:"connectionTypes,omitempty"`
+}
+
+func (r *rollup) add(s Sample) {
+	r.merge(sampleRollup(s))
+}
+
+func sampleRollup(s Sample) *rollup {
+	r := &rollup{Time: s.Time, Peer: s.Peer, IP: s.IP, Count: 1}
+	if !s.Success {
+		r.Failures = 1
+		return r
+	}
+	r.SumMs, r.MinMs, r.MaxMs = s.LatencyMs, s.LatencyMs, s.LatencyMs
+	r.ConnectionTypes = map[ConnectionType]int{s.ConnectionType: 1}
+	return r
+}
+
+func (r *rollup) merge(o *rollup) {
+	ok, other := r.Count-r.Failures, o.Count-o.Failures
+	if other > 0 {
+		if ok == 0 || o.MinMs < r.MinMs {
+			r.MinMs = o.MinMs
+		}
+		if ok == 0 || o.MaxMs > r.MaxMs {
+			r.MaxMs = o.MaxMs
+		}
+	}
+	r.Count += o.Count
+	r.Failures += o.Failures
+	r.SumMs += o.SumMs
+	for t, n := range o.ConnectionTypes {
+		if r.ConnectionTypes == nil {
+			r.ConnectionTypes = make(map[ConnectionType]int)
+		}
+		r.ConnectionTypes[t] += n
+	}
+}
+
+func (r *rollup) point() Point {
+	p := Point{
+		Time:            r.Time,
+		Count:           r.Count,
+		Failures:        r.Failures,
+		ConnectionTypes: r.ConnectionTypes,
+	}
+	if r.Count > 0 {
+		p.LossPercent = 100 * float64(r.Failures) / float64(r.Count)
+	}
+	if ok := r.Count - r.Failures; ok > 0 {
+		p.MinMs, p.MaxMs = r.MinMs, r.MaxMs
+		p.AvgMs = r.SumMs / float64(ok)
+	}
+	best := 0
+	for t, n := range r.ConnectionTypes {
+		if n > best || (n == best && t < p.ConnectionType) {
+			p.ConnectionType, best = t, n
+		}
+	}
+	return p
+}
+
+// Store keeps ping history as JSON lines in daily files: every sample for
+// the last two days, and 5 minute rollups and path events for the retention
+// period.
+type Store struct {
+	dir       string
+	retention time.Duration
+
+	mu      sync.Mutex
+	day     string
+	pending map[string]*rollup // current rollup bucket, by peer
+}
+
+func NewStore(dir string, retention time.Duration) *Store {
+	s := &Store{dir: dir, retention: retention, pending: make(map[string]*rollup)}
+	s.prune(time.Now())
+	return s
+}
+
+// Add records the samples from one round of pings.
+func (s *Store) Add(samples []Sample) error {
+	if len(samples) == 0 {
+		return nil
+	}
+	now := samples[0].Time
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return err
+	}
+	if day := now.UTC().Format(dayLayout); day != s.day {
+		s.day = day
+		s.prune(now)
+	}
+
+	lines := make(map[string][]any)
+	for _, sample := range samples {
+		path := s.path(rawPrefix, sample.Time)
+		lines[path] = append(lines[path], sample)
+
+		bucket := sample.Time.Truncate(rollupInterval)
+		r := s.pending[sample.Peer]
+		if r != nil && !r.Time.Equal(bucket) {
+			path := s.path(rollupPrefix, r.Time)
+			lines[path] = append(lines[path], r)
+			r = nil
+		}
+		if r == nil {
+			r = &rollup{Time: bucket, Peer: sample.Peer, IP: sample.IP}
+			s.pending[sample.Peer] = r
+		}
+		r.add(sample)
+	}
+
+	// Peers that have disappeared leave a finished bucket behind.
+	bucket := now.Truncate(rollupInterval)
+	for peer, r := range s.pending {
+		if r.Time.Before(bucket) {
+			path := s.path(rollupPrefix, r.Time)
+			lines[path] = append(lines[path], r)
+			delete(s.pending, peer)
+		}
+	}
+
+	for path, records := range lines {
+		if err := appendLines(path, records); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func appendLines(path string, records []any) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, rec := range records {
+		if err := enc.Encode(rec); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (s *Store) path(prefix string, t time.Time) string {
+	return filepath.Join(s.dir, prefix+t.UTC().Format(dayLayout)+historyExt)
+}
+
+// prune deletes raw files older than two days and rollups and events older
+// than the retention period.
+func (s *Store) prune(now time.Time) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return
+	}
+
+	cutoffs := map[string]string{rawPrefix: now.Add(-rawRetention).UTC().Format(dayLayout)}
+	if s.retention > 0 {
+		cutoffs[rollupPrefix] = now.Add(-s.retention).UTC().Format(dayLayout)
+		cutoffs[eventsPrefix] = cutoffs[rollupPrefix]
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		for prefix, cutoff := range cutoffs {
+			day, ok := fileDay(name, prefix)
+			if ok && day < cutoff {
+				if err := os.Remove(filepath.Join(s.dir, name)); err == nil {
+					log.Printf("Removed expired canary history %s", name)
+				}
+			}
+		}
+	}
+}
+
+func fileDay(name, prefix string) (string, bool) {
+	if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, historyExt) {
+		return "", false
+	}
+	day := strings.TrimSuffix(strings.TrimPrefix(name, prefix), historyExt)
+	if _, err := time.Parse(dayLayout, day); err != nil {
+		return "", false
+	}
+	return day, true
+}
+
+// HistoryQuery selects a peer's history. Peer matches a peer's DNS name,
+// hostname or Tailscale IP.
+type HistoryQuery struct {
+	Peer string
+	From time.Time
+	To   time.Time
+	Step time.Duration
+}
+
+// Query returns the peer's samples between From and To summarized in
+// buckets of Step. Steps under 5 minutes are served from raw samples,
+// which are only kept for two days; longer ones from rollups.
+func (s *Store) Query(q HistoryQuery) (*HistoryResponse, error) {
+	if q.Step <= 0 {
+		return nil, fmt.Errorf("step must be positive")
+	}
+	if !q.From.Before(q.To) {
+		return nil, fmt.Errorf("from must be before to")
+	}
+	if q.To.Sub(q.From)/q.Step > maxHistoryPoints {
+		return nil, fmt.Errorf("step %s is too small for the range, at most %d points are returned", q.Step, maxHistoryPoints)
+	}
+
+	useRaw := q.Step < rollupInterval
+	if !useRaw {
+		q.Step = q.Step.Round(rollupInterval)
+	}
+
+	buckets := make(map[time.Time]*rollup)
+	add := func(r *rollup) {
+		if r.Time.Before(q.From) || !r.Time.Before(q.To) || !matchesPeer(r.Peer, r.IP, q.Peer) {
+			return
+		}
+		t := q.From.Add(r.Time.Sub(q.From).Truncate(q.Step))
+		b := buckets[t]
+		if b == nil {
+			b = &rollup{Time: t}
+			buckets[t] = b
+		}
+		b.merge(r)
+	}
+
+	prefix := rollupPrefix
+	if useRaw {
+		prefix = rawPrefix
+	}
+	for day := q.From.UTC().Truncate(24 * time.Hour); day.Before(q.To); day = day.Add(24 * time.Hour) {
+		err := readLines(s.path(prefix, day), func(line []byte) {
+			if useRaw {
+				var sample Sample
+				if json.Unmarshal(line, &sample) == nil {
+					add(sampleRollup(sample))
+				}
+				return
+			}
+			var r rollup
+			if json.Unmarshal(line, &r) == nil {
+				add(&r)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !useRaw {
+		s.mu.Lock()
+		for _, r := range s.pending {
+			copied := *r
+			copied.ConnectionTypes = make(map[ConnectionType]int, len(r.ConnectionTypes))
+			for t, n := range r.ConnectionTypes {
+				copied.ConnectionTypes[t] = n
+			}
+			add(&copied)
+		}
+		s.mu.Unlock()
+	}
+
+	points := make([]Point, 0, len(buckets))
+	for _, b := range buckets {
+		points = append(points, b.point())
+	}
+	sort.Slice(points, func(i, j int) bool {
+		return points[i].Time.Before(points[j].Time)
+	})
+
+	return &HistoryResponse{
+		Peer:   q.Peer,
+		From:   q.From,
+		To:     q.To,
+		Step:   q.Step.String(),
+		Points: points,
+	}, nil
+}
+
+func readLines(path string, fn func(line []byte)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		fn(scanner.Bytes())
+	}
+	return scanner.Err()
+}
+
+func matchesPeer(name, ip, query string) bool {
+	query = strings.TrimSuffix(query, ".")
+	if strings.EqualFold(name, query) || ip == query {
+		return true
+	}
+	host, _, _ := strings.Cut(name, ".")
+	return strings.EqualFold(host, query)
+}
@@ -10,6 +10,7 @@ import (
 
 	"tailscale.com/client/tailscale"
 	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
 )
 
 type Pinger struct {
@@ -97,20 +98,70 @@ func extractHostnameFromDNS(dnsName string) string {
 	return dnsName
 }
 
-func (p *Pinger) Ping(ctx context.Context, ipStr string) (*PingResult, error) {
+// Ping pings ipStr at the layer given by pingType. A failed ping is
+// reported in the result; the error is only for invalid input.
+func (p *Pinger) Ping(ctx context.Context, ipStr string, pingType PingType) (*PingResult, error) {
 	ip, err := netip.ParseAddr(ipStr)
 	if err != nil {
 		return nil, fmt.Errorf("invalid IP address: %w", err)
 	}
 
-	// Use "disco" ping type - fastest, doesn't involve IP layer
-	result, err := p.lc.Ping(ctx, ip, "disco")
+	if pingType == PingLayered {
+		return p.pingLayered(ctx, ip), nil
+	}
+	return p.ping(ctx, ip, pingType), nil
+}
+
+// layerTimeout bounds each layer of a layered ping, so a slow layer
+// doesn't use up the time meant for the ones after it.
+const layerTimeout = 10 * time.Second
+
+// pingTimeout scales timeout, meant for a single ping, to cover every layer
+// a ping of pingType sends.
+func pingTimeout(pingType PingType, timeout time.Duration) time.Duration {
+	if pingType == PingLayered {
+		return timeout * time.Duration(len(layeredPingTypes))
+	}
+	return timeout
+}
+
+// pingLayered checks the path to ip one layer at a time, so the first
+// failure shows where it breaks: the WireGuard path, the peer's
+// tailscaled, its OS network stack or its peerapi. Connection details come
+// from the disco layer.
+func (p *Pinger) pingLayered(ctx context.Context, ip netip.Addr) *PingResult {
+	var layers []PingResult
+	for _, t := range layeredPingTypes {
+		layerCtx, cancel := context.WithTimeout(ctx, layerTimeout)
+		r := p.ping(layerCtx, ip, t)
+		cancel()
+		layers = append(layers, *r)
+		if !r.Success {
+			break
+		}
+	}
+
+	result := layers[0]
+	result.Type = PingLayered
+	result.Layers = layers
+	if last := layers[len(layers)-1]; !last.Success {
+		result.Success = false
+		result.FailedLayer = last.Type
+		result.Error = fmt.Sprintf("%s ping failed: %s", last.Type, last.Error)
+	}
+	return &result
+}
+
+func (p *Pinger) ping(ctx context.Context, ip netip.Addr, pingType PingType) *PingResult {
+	ipStr := ip.String()
+	result, err := p.lc.Ping(ctx, ip, tailcfg.PingType(pingType))
 	if err != nil {
 		return &PingResult{
 			IP:      ipStr,
 			Success: false,
 			Error:   err.Error(),
-		}, nil
+			Type:    pingType,
+		}
 	}
 
 	if result.Err != "" {
@@ -119,7 +170,8 @@ func (p *Pinger) Ping(ctx context.Context, ipStr string) (*PingResult, error) {
 			NodeName: result.NodeName,
 			Success:  false,
 			Error:    result.Err,
-		}, nil
+			Type:     pingType,
+		}
 	}
 
 	connType := p.determineConnectionType(result)
@@ -135,10 +187,11 @@ func (p *Pinger) Ping(ctx context.Context, ipStr string) (*PingResult, error) {
 		DERPRegion:     result.DERPRegionCode,
 		DERPRegionID:   result.DERPRegionID,
 		PeerRelay:      result.PeerRelay,
-	}, nil
+		Type:           pingType,
+	}
 }
 
-func (p *Pinger) PingAll(ctx context.Context) (*PingAllResponse, error) {
+func (p *Pinger) PingAll(ctx context.Context, pingType PingType) (*PingAllResponse, error) {
 	peers, err := p.GetPeers(ctx)
 	if err != nil {
 		return nil, err
@@ -158,17 +211,17 @@ func (p *Pinger) PingAll(ctx context.Context) (*PingAllResponse, error) {
 			defer wg.Done()
 
 			// Try with 10 second timeout first
-			pingCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			pingCtx, cancel := context.WithTimeout(ctx, pingTimeout(pingType, 10*time.Second))
 			defer cancel()
 
-			result, err := p.Ping(pingCtx, ip)
+			result, err := p.Ping(pingCtx, ip, pingType)
 
 			// If it timed out, try one more time with a shorter timeout (5s)
 			if err != nil && (result == nil || !result.Success) {
-				retryCtx, retryCancel := context.WithTimeout(ctx, 5*time.Second)
+				retryCtx, retryCancel := context.WithTimeout(ctx, pingTimeout(pingType, 5*time.Second))
 				defer retryCancel()
 
-				retryResult, retryErr := p.Ping(retryCtx, ip)
+				retryResult, retryErr := p.Ping(retryCtx, ip, pingType)
 				if retryErr == nil && retryResult != nil && retryResult.Success {
 					result = retryResult
 					err = nil
@@ -0,0 +1,139 @@
+package canary
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scheduler pings every peer on a fixed interval and records the results
+// in a Store, so history survives page loads and restarts.
+type Scheduler struct {
+	pinger   *Pinger
+	store    *Store
+	interval time.Duration
+	pingType PingType
+
+	mu        sync.Mutex
+	observers []func(Round)
+}
+
+func NewScheduler(pinger *Pinger, store *Store, interval time.Duration, pingType PingType) *Scheduler {
+	return &Scheduler{pinger: pinger, store: store, interval: interval, pingType: pingType}
+}
+
+// Round is the outcome of one round of scheduled pings. Samples are in the
+// same order as Peers, which only includes peers with a Tailscale IP.
+type Round struct {
+	Time    time.Time
+	Peers   []PeerInfo
+	Samples []Sample
+}
+
+// OnRound registers fn to be called after every round. Calls are made
+// from the scheduler's goroutine, so fn should not block.
+func (s *Scheduler) OnRound(fn func(Round)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.observers = append(s.observers, fn)
+}
+
+// Run pings peers every interval until ctx is done.
+func (s *Scheduler) Run(ctx context.Context) {
+	log.Printf("Canary pinging peers every %s (%s)", s.interval, s.pingType)
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		s.round(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// round pings each online peer once. Offline peers are recorded as
+// failures without being pinged.
+func (s *Scheduler) round(ctx context.Context) {
+	peers, err := s.pinger.GetPeers(ctx)
+	if err != nil {
+		log.Printf("Canary: failed to list peers: %v", err)
+		return
+	}
+
+	now := time.Now()
+	round := Round{Time: now}
+	var wg sync.WaitGroup
+
+	// Pings may take up to the interval, but no longer, so rounds don't
+	// pile up.
+	timeout := min(s.interval, pingTimeout(s.pingType, 10*time.Second))
+
+	for _, peer := range peers.Peers {
+		if peer.IP == "" {
+			continue
+		}
+		sample := Sample{
+			Time: now,
+			Peer: strings.TrimSuffix(peer.DNSName, "."),
+			IP:   peer.IP,
+		}
+		if sample.Peer == "" {
+			sample.Peer = peer.HostName
+		}
+		if !peer.Online {
+			sample.ConnectionType = ConnectionOffline
+			sample.Error = "peer is offline"
+		}
+		round.Peers = append(round.Peers, peer)
+		round.Samples = append(round.Samples, sample)
+	}
+
+	for i := range round.Samples {
+		sample := &round.Samples[i]
+		if !round.Peers[i].Online {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			pingCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			result, err := s.pinger.Ping(pingCtx, sample.IP, s.pingType)
+			if err != nil {
+				sample.Error = err.Error()
+			} else {
+				sample.Success = result.Success
+				sample.LatencyMs = result.LatencyMs
+				sample.ConnectionType = result.ConnectionType
+				sample.Endpoint = result.Endpoint
+				sample.DERPRegion = result.DERPRegion
+				sample.PeerRelay = result.PeerRelay
+				sample.Error = result.Error
+			}
+			if !sample.Success && sample.ConnectionType == "" {
+				sample.ConnectionType = ConnectionUnknown
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := s.store.Add(round.Samples); err != nil {
+		log.Printf("Canary: failed to record history: %v", err)
+	}
+
+	s.mu.Lock()
+	observers := s.observers
+	s.mu.Unlock()
+	for _, fn := range observers {
+		fn(round)
+	}
+}
@@ -1,6 +1,12 @@
 package canary
 
-import "time"
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"tailscale.com/tailcfg"
+)
 
 type ConnectionType string
 
@@ -12,6 +18,44 @@ const (
 	ConnectionUnknown   ConnectionType = "unknown"
 )
 
+// PingType selects which layer of the path to a peer a ping exercises.
+type PingType string
+
+const (
+	// PingDisco checks the WireGuard path without involving either IP stack.
+	PingDisco = PingType(tailcfg.PingDisco)
+	// PingTSMP goes through WireGuard to the peer's tailscaled.
+	PingTSMP = PingType(tailcfg.PingTSMP)
+	// PingICMP is answered by the peer's operating system.
+	PingICMP = PingType(tailcfg.PingICMP)
+	// PingPeerAPI makes an HTTP request to the peer's peerapi server.
+	PingPeerAPI = PingType(tailcfg.PingPeerAPI)
+	// PingLayered runs each of the above in turn and stops at the first
+	// that fails.
+	PingLayered PingType = "layered"
+)
+
+// layeredPingTypes are the layers PingLayered checks, lowest first.
+var layeredPingTypes = []PingType{PingDisco, PingTSMP, PingICMP, PingPeerAPI}
+
+// ParsePingType parses a ping type case-insensitively. An empty string
+// means PingDisco.
+func ParsePingType(s string) (PingType, error) {
+	switch strings.ToLower(s) {
+	case "", "disco":
+		return PingDisco, nil
+	case "tsmp":
+		return PingTSMP, nil
+	case "icmp":
+		return PingICMP, nil
+	case "peerapi":
+		return PingPeerAPI, nil
+	case "layered":
+		return PingLayered, nil
+	}
+	return "", fmt.Errorf("unknown ping type %q, expected disco, tsmp, icmp, peerapi or layered", s)
+}
+
 type PeerInfo struct {
 	HostName      string         `json:"hostName"`
 	DNSName       string         `json:"dnsName"`
@@ -41,6 +85,12 @@ type PingResult struct {
 	DERPRegion     string         `json:"derpRegion,omitempty"`
 	DERPRegionID   int            `json:"derpRegionId,omitempty"`
 	PeerRelay      string         `json:"peerRelay,omitempty"`
+	Type           PingType       `json:"type"`
+
+	// For layered pings, FailedLayer is the first layer that failed and
+	// Layers holds the result of each layer that was tried.
+	FailedLayer PingType     `json:"failedLayer,omitempty"`
+	Layers      []PingResult `json:"layers,omitempty"`
 }
 
 type PeersResponse struct {
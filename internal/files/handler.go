@@ -0,0 +1,414 @@
+package files
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/pkg/sftp"
+	"github.com/rajsinghtech/tailtunnel/internal/audit"
+	"github.com/rajsinghtech/tailtunnel/internal/policy"
+	"github.com/rajsinghtech/tailtunnel/internal/ssh"
+)
+
+// OpenFunc starts an sftp session on machine as user for the caller in ctx.
+// It matches (*ssh.SSHHandler).OpenSFTP.
+type OpenFunc func(ctx context.Context, machine, user string) (*sftp.Client, func(), error)
+
+// Entry describes a remote file or directory.
+type Entry struct {
+	Name    string    `json:"name"`
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	Mode    string    `json:"mode"`
+	ModTime time.Time `json:"modTime"`
+	IsDir   bool      `json:"isDir"`
+	IsLink  bool      `json:"isLink,omitempty"`
+}
+
+type listResponse struct {
+	Path    string  `json:"path"`
+	Entries []Entry `json:"entries"`
+}
+
+type renameRequest struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// Handler serves the file API. Every request opens its own sftp session on
+// the machine in the URL, as the remote user in the "user" query parameter
+// (root by default), subject to the same policy as interactive SSH.
+type Handler struct {
+	open  OpenFunc
+	audit *audit.Logger
+}
+
+func NewHandler(open OpenFunc, audit *audit.Logger) *Handler {
+	return &Handler{open: open, audit: audit}
+}
+
+// List returns the entries of the directory at "path", which defaults to the
+// remote user's home directory.
+func (h *Handler) List(w http.ResponseWriter, r *http.Request) {
+	sc, done, ok := h.client(w, r)
+	if !ok {
+		return
+	}
+	defer done()
+
+	dir, err := sc.RealPath(queryPath(r))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	infos, err := sc.ReadDir(dir)
+	if err != nil {
+		writeError(w, fmt.Errorf("%s: %w", dir, err))
+		return
+	}
+
+	entries := make([]Entry, 0, len(infos))
+	for _, fi := range infos {
+		entries = append(entries, newEntry(path.Join(dir, fi.Name()), fi))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(listResponse{Path: dir, Entries: entries})
+}
+
+// Stat describes the file at "path", following symlinks.
+func (h *Handler) Stat(w http.ResponseWriter, r *http.Request) {
+	sc, done, ok := h.client(w, r)
+	if !ok {
+		return
+	}
+	defer done()
+
+	p, err := sc.RealPath(queryPath(r))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	fi, err := sc.Stat(p)
+	if err != nil {
+		writeError(w, fmt.Errorf("%s: %w", p, err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newEntry(p, fi))
+}
+
+// Download streams the file at "path". Range requests are supported so
+// large transfers can be resumed.
+func (h *Handler) Download(w http.ResponseWriter, r *http.Request) {
+	sc, done, ok := h.client(w, r)
+	if !ok {
+		return
+	}
+	defer done()
+
+	p := queryPath(r)
+	f, err := sc.Open(p)
+	if err != nil {
+		writeError(w, fmt.Errorf("%s: %w", p, err))
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		writeError(w, fmt.Errorf("%s: %w", p, err))
+		return
+	}
+	if fi.IsDir() {
+		http.Error(w, p+" is a directory", http.StatusBadRequest)
+		return
+	}
+
+	h.log(r, audit.ActionFileRead, "download", p, map[string]any{"size": fi.Size()})
+
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(p)}))
+	http.ServeContent(w, r, path.Base(p), fi.ModTime(), f)
+}
+
+// Upload writes every file in a multipart form into the directory at
+// "path", streaming each part straight to the remote file. Existing files
+// are only replaced when "overwrite=true".
+func (h *Handler) Upload(w http.ResponseWriter, r *http.Request) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "Expected a multipart/form-data body", http.StatusBadRequest)
+		return
+	}
+
+	sc, done, ok := h.client(w, r)
+	if !ok {
+		return
+	}
+	defer done()
+
+	dir, err := sc.RealPath(queryPath(r))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	overwrite := r.URL.Query().Get("overwrite") == "true"
+
+	uploaded := []Entry{}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to read upload: %v", err), http.StatusBadRequest)
+			return
+		}
+		if part.FileName() == "" {
+			part.Close()
+			continue
+		}
+
+		target := path.Join(dir, path.Base(part.FileName()))
+		entry, err := upload(sc, target, overwrite, part)
+		part.Close()
+		if err != nil {
+			log.Printf("Failed to upload %s: %v", target, err)
+			writeError(w, fmt.Errorf("%s: %w", target, err))
+			return
+		}
+		uploaded = append(uploaded, *entry)
+
+		h.log(r, audit.ActionFileWrite, "upload", target, map[string]any{"size": entry.Size})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(uploaded)
+}
+
+// upload writes src to a temporary file next to target and renames it over
+// target once it is complete, so a failed upload never leaves target
+// truncated or half written.
+func upload(sc *sftp.Client, target string, overwrite bool, src io.Reader) (*Entry, error) {
+	// Not every server refuses to rename over an existing file, so check
+	// first.
+	if !overwrite {
+		if _, err := sc.Lstat(target); err == nil {
+			return nil, os.ErrExist
+		}
+	}
+
+	b := make([]byte, 6)
+	rand.Read(b)
+	tmp := path.Join(path.Dir(target), fmt.Sprintf(".%s.%x.upload", path.Base(target), b))
+
+	f, err := sc.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.ReadFrom(src); err != nil {
+		f.Close()
+		sc.Remove(tmp)
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		sc.Remove(tmp)
+		return nil, err
+	}
+
+	if err := rename(sc, tmp, target, overwrite); err != nil {
+		sc.Remove(tmp)
+		return nil, err
+	}
+
+	fi, err := sc.Stat(target)
+	if err != nil {
+		return nil, err
+	}
+	entry := newEntry(target, fi)
+	return &entry, nil
+}
+
+// rename moves from to to. Plain SFTP renames fail if to exists, so
+// replacing it needs the posix-rename extension, which OpenSSH supports.
+func rename(sc *sftp.Client, from, to string, overwrite bool) error {
+	if !overwrite {
+		return sc.Rename(from, to)
+	}
+	if _, ok := sc.HasExtension("posix-rename@openssh.com"); ok {
+		return sc.PosixRename(from, to)
+	}
+	if err := sc.Remove(to); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return sc.Rename(from, to)
+}
+
+// Mkdir creates the directory at "path", along with any missing parents
+// when "parents=true".
+func (h *Handler) Mkdir(w http.ResponseWriter, r *http.Request) {
+	sc, done, ok := h.client(w, r)
+	if !ok {
+		return
+	}
+	defer done()
+
+	p := queryPath(r)
+	var err error
+	if r.URL.Query().Get("parents") == "true" {
+		err = sc.MkdirAll(p)
+	} else {
+		err = sc.Mkdir(p)
+	}
+	if err != nil {
+		writeError(w, fmt.Errorf("%s: %w", p, err))
+		return
+	}
+
+	h.log(r, audit.ActionFileWrite, "mkdir", p, nil)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// Rename moves a file or directory, taking a JSON body with "from" and "to".
+func (h *Handler) Rename(w http.ResponseWriter, r *http.Request) {
+	var req renameRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.From == "" || req.To == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	sc, done, ok := h.client(w, r)
+	if !ok {
+		return
+	}
+	defer done()
+
+	if err := sc.Rename(req.From, req.To); err != nil {
+		writeError(w, fmt.Errorf("%s: %w", req.From, err))
+		return
+	}
+
+	h.log(r, audit.ActionFileWrite, "rename", req.From, map[string]any{"to": req.To})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Delete removes the file or empty directory at "path". Non-empty
+// directories are only removed with "recursive=true".
+func (h *Handler) Delete(w http.ResponseWriter, r *http.Request) {
+	sc, done, ok := h.client(w, r)
+	if !ok {
+		return
+	}
+	defer done()
+
+	p := queryPath(r)
+	fi, err := sc.Lstat(p)
+	if err != nil {
+		writeError(w, fmt.Errorf("%s: %w", p, err))
+		return
+	}
+
+	switch {
+	case fi.IsDir() && r.URL.Query().Get("recursive") == "true":
+		err = sc.RemoveAll(p)
+	case fi.IsDir():
+		err = sc.RemoveDirectory(p)
+	default:
+		err = sc.Remove(p)
+	}
+	if err != nil {
+		writeError(w, fmt.Errorf("%s: %w", p, err))
+		return
+	}
+
+	h.log(r, audit.ActionFileWrite, "delete", p, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// client opens an sftp session for the request, writing an error response
+// if that fails.
+func (h *Handler) client(w http.ResponseWriter, r *http.Request) (*sftp.Client, func(), bool) {
+	sc, done, err := h.open(r.Context(), chi.URLParam(r, "machine"), remoteUser(r))
+	if err != nil {
+		log.Printf("Failed to open sftp session: %v", err)
+		writeError(w, err)
+		return nil, nil, false
+	}
+	return sc, done, true
+}
+
+func (h *Handler) log(r *http.Request, action, op, p string, details map[string]any) {
+	ev := audit.NewEvent(r.Context(), action)
+	ev.Outcome = audit.OutcomeSuccess
+	ev.Machine = chi.URLParam(r, "machine")
+	ev.RemoteUser = remoteUser(r)
+	if details == nil {
+		details = map[string]any{}
+	}
+	details["op"] = op
+	details["path"] = p
+	ev.Details = details
+	h.audit.Log(ev)
+}
+
+func remoteUser(r *http.Request) string {
+	if user := r.URL.Query().Get("user"); user != "" {
+		return user
+	}
+	return "root"
+}
+
+func queryPath(r *http.Request) string {
+	if p := r.URL.Query().Get("path"); p != "" {
+		return p
+	}
+	return "."
+}
+
+func newEntry(p string, fi os.FileInfo) Entry {
+	return Entry{
+		Name:    fi.Name(),
+		Path:    p,
+		Size:    fi.Size(),
+		Mode:    fi.Mode().String(),
+		ModTime: fi.ModTime(),
+		IsDir:   fi.IsDir(),
+		IsLink:  fi.Mode()&os.ModeSymlink != 0,
+	}
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	var setupErr *ssh.SetupError
+	var denied *policy.DeniedError
+	var status int
+	switch {
+	case errors.As(err, &denied):
+		status = http.StatusForbidden
+	case errors.As(err, &setupErr):
+		status = http.StatusBadGateway
+	case errors.Is(err, os.ErrNotExist):
+		status = http.StatusNotFound
+	case errors.Is(err, os.ErrPermission):
+		status = http.StatusForbidden
+	case errors.Is(err, os.ErrExist):
+		status = http.StatusConflict
+	default:
+		status = http.StatusInternalServerError
+	}
+	http.Error(w, err.Error(), status)
+}
@@ -0,0 +1,134 @@
+package fleet
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rajsinghtech/tailtunnel/internal/identity"
+)
+
+// Handler serves the fleet run API. Runs are only visible to the tailnet
+// identity that started them.
+type Handler struct {
+	runner *Runner
+}
+
+func NewHandler(runner *Runner) *Handler {
+	return &Handler{runner: runner}
+}
+
+// Create starts a run from the JSON-encoded Request in the body and
+// responds with the run, before any host has finished.
+func (h *Handler) Create(w http.ResponseWriter, r *http.Request) {
+	var req Request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	run, err := h.runner.Start(r.Context(), req)
+	if err != nil {
+		log.Printf("Failed to start fleet run: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(run)
+}
+
+func (h *Handler) List(w http.ResponseWriter, r *http.Request) {
+	runs, err := h.runner.List()
+	if err != nil {
+		log.Printf("Failed to list fleet runs: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	caller := identity.OwnerName(r.Context())
+	mine := []Run{}
+	for _, run := range runs {
+		if run.Identity == caller {
+			mine = append(mine, run)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(mine)
+}
+
+// Get responds with a run and every host result so far.
+func (h *Handler) Get(w http.ResponseWriter, r *http.Request) {
+	run, ok := h.ownedRun(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(run)
+}
+
+// Events streams a run as server-sent events: "run" with the run itself,
+// "host" for each host result as it arrives, and finally "summary" with
+// the finished run and its grouped results. Finished runs are replayed
+// from the store.
+func (h *Handler) Events(w http.ResponseWriter, r *http.Request) {
+	run, ok := h.ownedRun(w, r)
+	if !ok {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	writeSSE(w, "run", run.brief())
+	flusher.Flush()
+
+	final, err := h.runner.Follow(r.Context(), run.ID, func(hr HostResult) {
+		writeSSE(w, "host", hr)
+		flusher.Flush()
+	})
+	if err != nil {
+		return
+	}
+
+	final.Results = nil
+	writeSSE(w, "summary", final)
+	flusher.Flush()
+}
+
+func (h *Handler) ownedRun(w http.ResponseWriter, r *http.Request) (*Run, bool) {
+	run, err := h.runner.Get(chi.URLParam(r, "id"))
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return nil, false
+		}
+		log.Printf("Failed to load fleet run: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+
+	if run.Identity != identity.OwnerName(r.Context()) {
+		http.Error(w, ErrNotFound.Error(), http.StatusNotFound)
+		return nil, false
+	}
+	return run, true
+}
+
+func writeSSE(w io.Writer, event string, v any) {
+	data, _ := json.Marshal(v)
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+}
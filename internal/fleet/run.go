@@ -0,0 +1,412 @@
+package fleet
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rajsinghtech/tailtunnel/internal/audit"
+	"github.com/rajsinghtech/tailtunnel/internal/identity"
+	"github.com/rajsinghtech/tailtunnel/internal/ssh"
+	"github.com/rajsinghtech/tailtunnel/internal/tailscale"
+)
+
+const (
+	defaultConcurrency = 10
+	maxConcurrency     = 50
+)
+
+// ErrNoMachines is returned when a selector matches no online machines.
+var ErrNoMachines = errors.New("selector matched no online machines")
+
+// Request is a command to run on every machine matched by Selector.
+// Timeout applies to each host separately.
+type Request struct {
+	Selector    string `json:"selector"`
+	Concurrency int    `json:"concurrency,omitempty"`
+	ssh.ExecRequest
+}
+
+// Run is a fleet-wide command and, once hosts report back, its results.
+type Run struct {
+	ID          string     `json:"id"`
+	Identity    string     `json:"identity,omitempty"`
+	Selector    string     `json:"selector"`
+	Command     string     `json:"command"`
+	User        string     `json:"user"`
+	Timeout     string     `json:"timeout,omitempty"`
+	Concurrency int        `json:"concurrency"`
+	Hosts       []string   `json:"hosts"`
+	Skipped     []string   `json:"skipped,omitempty"`
+	StartedAt   time.Time  `json:"startedAt"`
+	FinishedAt  *time.Time `json:"finishedAt,omitempty"`
+	Succeeded   int        `json:"succeeded"`
+	Failed      int        `json:"failed"`
+
+	// Results are in the order hosts finished.
+	Results []HostResult `json:"results,omitempty"`
+	Summary []Group      `json:"summary,omitempty"`
+}
+
+// HostResult is the outcome on one machine. Error is set instead of Result
+// when the command could not be started there.
+type HostResult struct {
+	Machine string          `json:"machine"`
+	Result  *ssh.ExecResult `json:"result,omitempty"`
+	Error   string          `json:"error,omitempty"`
+}
+
+func (hr *HostResult) succeeded() bool {
+	return hr.Result != nil && hr.Result.ExitCode != nil && *hr.Result.ExitCode == 0 && hr.Result.Error == ""
+}
+
+// Group is a set of hosts that produced identical output and exit status.
+type Group struct {
+	ExitCode *int     `json:"exitCode,omitempty"`
+	Signal   string   `json:"signal,omitempty"`
+	Error    string   `json:"error,omitempty"`
+	Stdout   string   `json:"stdout,omitempty"`
+	Stderr   string   `json:"stderr,omitempty"`
+	Hosts    []string `json:"hosts"`
+}
+
+// brief returns a copy of the run without per-host results, for listings.
+func (run *Run) brief() Run {
+	b := *run
+	b.Results = nil
+	b.Summary = nil
+	return b
+}
+
+// ExecFunc runs a single command on a machine on behalf of the caller in
+// ctx. It matches (*ssh.SSHHandler).Exec.
+type ExecFunc func(ctx context.Context, machine string, req ssh.ExecRequest, onOutput func(stream string, p []byte)) (*ssh.ExecResult, error)
+
+// MachinesFunc lists the machines a selector is matched against.
+type MachinesFunc func(ctx context.Context) (*tailscale.MachineListResponse, error)
+
+// Runner starts fleet runs, tracks the ones still in progress and persists
+// them to a Store when they finish.
+type Runner struct {
+	exec     ExecFunc
+	machines MachinesFunc
+	store    *Store
+	audit    *audit.Logger
+
+	mu   sync.Mutex
+	live map[string]*liveRun
+}
+
+func NewRunner(exec ExecFunc, machines MachinesFunc, store *Store, audit *audit.Logger) *Runner {
+	return &Runner{
+		exec:     exec,
+		machines: machines,
+		store:    store,
+		audit:    audit,
+		live:     make(map[string]*liveRun),
+	}
+}
+
+// liveRun is a run in progress. changed is closed and replaced whenever a
+// host finishes so followers can wait for updates.
+type liveRun struct {
+	mu      sync.Mutex
+	run     *Run
+	changed chan struct{}
+}
+
+func (lr *liveRun) update(fn func(run *Run)) {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	fn(lr.run)
+	close(lr.changed)
+	lr.changed = make(chan struct{})
+}
+
+// Start resolves req's selector and begins running the command on every
+// online machine it matches. The run continues after ctx is canceled, but
+// keeps the caller's identity for authorization and auditing.
+func (r *Runner) Start(ctx context.Context, req Request) (*Run, error) {
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+	selector, err := ParseSelector(req.Selector)
+	if err != nil {
+		return nil, err
+	}
+
+	concurrency := req.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultConcurrency
+	}
+	if concurrency > maxConcurrency {
+		concurrency = maxConcurrency
+	}
+
+	list, err := r.machines(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list machines: %w", err)
+	}
+
+	var hosts, skipped []string
+	for i := range list.Machines {
+		m := &list.Machines[i]
+		if !selector.Match(m) {
+			continue
+		}
+		name := machineName(m)
+		if m.Online {
+			hosts = append(hosts, name)
+		} else {
+			skipped = append(skipped, name)
+		}
+	}
+	if len(hosts) == 0 {
+		return nil, ErrNoMachines
+	}
+	sort.Strings(hosts)
+	sort.Strings(skipped)
+
+	now := time.Now()
+	id, err := newID(now)
+	if err != nil {
+		return nil, err
+	}
+
+	run := &Run{
+		ID:          id,
+		Identity:    identity.OwnerName(ctx),
+		Selector:    req.Selector,
+		Command:     req.Command,
+		User:        req.User,
+		Timeout:     req.Timeout,
+		Concurrency: concurrency,
+		Hosts:       hosts,
+		Skipped:     skipped,
+		StartedAt:   now,
+	}
+
+	lr := &liveRun{run: run, changed: make(chan struct{})}
+	r.mu.Lock()
+	r.live[id] = lr
+	r.mu.Unlock()
+
+	ev := audit.NewEvent(ctx, audit.ActionFleetRun)
+	ev.Outcome = audit.OutcomeSuccess
+	ev.RemoteUser = req.User
+	ev.Details = map[string]any{
+		"run":      id,
+		"selector": req.Selector,
+		"command":  req.Command,
+		"hosts":    len(hosts),
+	}
+	r.audit.Log(ev)
+
+	brief := run.brief()
+	go r.execute(context.WithoutCancel(ctx), lr, req.ExecRequest)
+	return &brief, nil
+}
+
+func (r *Runner) execute(ctx context.Context, lr *liveRun, req ssh.ExecRequest) {
+	run := lr.run
+	sem := make(chan struct{}, run.Concurrency)
+
+	var wg sync.WaitGroup
+	for _, host := range run.Hosts {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			hr := HostResult{Machine: host}
+			result, err := r.exec(ctx, host, req, nil)
+			if err != nil {
+				hr.Error = err.Error()
+			} else {
+				hr.Result = result
+			}
+
+			lr.update(func(run *Run) {
+				run.Results = append(run.Results, hr)
+				if hr.succeeded() {
+					run.Succeeded++
+				} else {
+					run.Failed++
+				}
+			})
+		}()
+	}
+	wg.Wait()
+
+	lr.update(func(run *Run) {
+		run.Summary = summarize(run.Results)
+		finished := time.Now()
+		run.FinishedAt = &finished
+	})
+
+	// Save before dropping the live copy so a concurrent Get always finds
+	// the run in one place or the other.
+	lr.mu.Lock()
+	err := r.store.Save(run)
+	lr.mu.Unlock()
+	if err != nil {
+		log.Printf("Failed to save fleet run %s: %v", run.ID, err)
+	}
+
+	r.mu.Lock()
+	delete(r.live, run.ID)
+	r.mu.Unlock()
+
+	log.Printf("Fleet run %s finished: %d succeeded, %d failed", run.ID, run.Succeeded, run.Failed)
+}
+
+// Get returns a snapshot of a run, whether it is still in progress or not.
+func (r *Runner) Get(id string) (*Run, error) {
+	r.mu.Lock()
+	lr, ok := r.live[id]
+	r.mu.Unlock()
+	if !ok {
+		return r.store.Get(id)
+	}
+
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	snapshot := *lr.run
+	snapshot.Results = append([]HostResult(nil), lr.run.Results...)
+	return &snapshot, nil
+}
+
+// List returns runs in progress and finished runs, newest first, without
+// their per-host results.
+func (r *Runner) List() ([]Run, error) {
+	runs, err := r.store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool, len(runs))
+	for _, run := range runs {
+		seen[run.ID] = true
+	}
+
+	r.mu.Lock()
+	for id, lr := range r.live {
+		if seen[id] {
+			continue
+		}
+		lr.mu.Lock()
+		runs = append(runs, lr.run.brief())
+		lr.mu.Unlock()
+	}
+	r.mu.Unlock()
+
+	sortRuns(runs)
+	return runs, nil
+}
+
+// Follow calls onResult for every host result of run id, first for those
+// already in and then for each host as it finishes, and returns the run once
+// it is complete. It returns early with ctx's error if ctx is canceled.
+func (r *Runner) Follow(ctx context.Context, id string, onResult func(HostResult)) (*Run, error) {
+	r.mu.Lock()
+	lr, ok := r.live[id]
+	r.mu.Unlock()
+	if !ok {
+		run, err := r.store.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		for _, hr := range run.Results {
+			onResult(hr)
+		}
+		return run, nil
+	}
+
+	sent := 0
+	for {
+		lr.mu.Lock()
+		pending := lr.run.Results[sent:]
+		done := lr.run.FinishedAt != nil
+		changed := lr.changed
+		snapshot := *lr.run
+		lr.mu.Unlock()
+
+		for _, hr := range pending {
+			onResult(hr)
+		}
+		sent += len(pending)
+		if done {
+			return &snapshot, nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// summarize groups hosts whose command ended the same way with the same
+// output, largest group first.
+func summarize(results []HostResult) []Group {
+	groups := make(map[[sha256.Size]byte]*Group)
+	var order []*Group
+
+	for _, hr := range results {
+		g := Group{Error: hr.Error}
+		if res := hr.Result; res != nil {
+			g.ExitCode = res.ExitCode
+			g.Signal = res.Signal
+			g.Stdout = res.Stdout
+			g.Stderr = res.Stderr
+			if res.Error != "" {
+				g.Error = res.Error
+			}
+		}
+
+		h := sha256.New()
+		exitCode := "none"
+		if g.ExitCode != nil {
+			exitCode = fmt.Sprint(*g.ExitCode)
+		}
+		for _, part := range []string{exitCode, g.Signal, g.Error, g.Stdout, g.Stderr} {
+			fmt.Fprintf(h, "%d:%s", len(part), part)
+		}
+		var key [sha256.Size]byte
+		h.Sum(key[:0])
+
+		existing, ok := groups[key]
+		if !ok {
+			existing = &g
+			groups[key] = existing
+			order = append(order, existing)
+		}
+		existing.Hosts = append(existing.Hosts, hr.Machine)
+	}
+
+	summary := make([]Group, 0, len(order))
+	for _, g := range order {
+		sort.Strings(g.Hosts)
+		summary = append(summary, *g)
+	}
+	sort.SliceStable(summary, func(i, j int) bool {
+		return len(summary[i].Hosts) > len(summary[j].Hosts)
+	})
+	return summary
+}
+
+// machineName is the name a run dials, matching the names the browser uses.
+func machineName(m *tailscale.Machine) string {
+	if name := strings.TrimSuffix(m.DNSName, "."); name != "" {
+		return name
+	}
+	return m.HostName
+}
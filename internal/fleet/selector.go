@@ -0,0 +1,199 @@
+package fleet
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/rajsinghtech/tailtunnel/internal/tailscale"
+)
+
+// Selector picks machines out of the tailnet. Selectors are boolean
+// expressions over terms of the form key:pattern, for example
+//
+//	tag:prod && os:linux
+//	(host:web-* || host:api-*) && !tag:canary
+//
+// Supported keys are tag, os, user (the owner's login name) and host (the
+// hostname, MagicDNS name or short name). Patterns may use path.Match
+// globs and are case-insensitive. A bare "*" selects every machine.
+type Selector struct {
+	expr  string
+	match func(*tailscale.Machine) bool
+}
+
+// ParseSelector compiles expr into a Selector.
+func ParseSelector(expr string) (*Selector, error) {
+	tokens, err := tokenize(expr)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty selector")
+	}
+
+	p := &parser{tokens: tokens}
+	match, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in selector", p.tokens[p.pos])
+	}
+	return &Selector{expr: expr, match: match}, nil
+}
+
+// Match reports whether m is selected.
+func (s *Selector) Match(m *tailscale.Machine) bool {
+	return s.match(m)
+}
+
+func (s *Selector) String() string {
+	return s.expr
+}
+
+func tokenize(expr string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(expr); {
+		switch c := expr[i]; {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '(' || c == ')' || c == '!':
+			tokens = append(tokens, string(c))
+			i++
+		case strings.HasPrefix(expr[i:], "&&") || strings.HasPrefix(expr[i:], "||"):
+			tokens = append(tokens, expr[i:i+2])
+			i += 2
+		case c == '&' || c == '|':
+			return nil, fmt.Errorf("use %q instead of %q in selector", string(c)+string(c), string(c))
+		default:
+			j := i
+			for j < len(expr) && !strings.ContainsRune(" \t\n()!&|", rune(expr[j])) {
+				j++
+			}
+			tokens = append(tokens, expr[i:j])
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+type parser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *parser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *parser) parseOr() (func(*tailscale.Machine) bool, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "||" {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(m *tailscale.Machine) bool { return l(m) || right(m) }
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (func(*tailscale.Machine) bool, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "&&" {
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(m *tailscale.Machine) bool { return l(m) && right(m) }
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary() (func(*tailscale.Machine) bool, error) {
+	switch tok := p.peek(); tok {
+	case "":
+		return nil, fmt.Errorf("unexpected end of selector")
+	case "!":
+		p.pos++
+		inner, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(m *tailscale.Machine) bool { return !inner(m) }, nil
+	case "(":
+		p.pos++
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("missing ) in selector")
+		}
+		p.pos++
+		return inner, nil
+	case ")", "&&", "||":
+		return nil, fmt.Errorf("unexpected %q in selector", tok)
+	default:
+		p.pos++
+		return parseTerm(tok)
+	}
+}
+
+func parseTerm(term string) (func(*tailscale.Machine) bool, error) {
+	if term == "*" {
+		return func(*tailscale.Machine) bool { return true }, nil
+	}
+
+	key, pattern, ok := strings.Cut(term, ":")
+	if !ok || pattern == "" {
+		return nil, fmt.Errorf("invalid selector term %q, expected key:pattern", term)
+	}
+	pattern = strings.ToLower(pattern)
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid pattern in %q: %w", term, err)
+	}
+
+	switch key {
+	case "tag":
+		return func(m *tailscale.Machine) bool {
+			for _, tag := range m.Tags {
+				if glob(pattern, strings.TrimPrefix(tag, "tag:")) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	case "os":
+		return func(m *tailscale.Machine) bool { return glob(pattern, m.OS) }, nil
+	case "user":
+		return func(m *tailscale.Machine) bool { return glob(pattern, m.UserLogin) }, nil
+	case "host":
+		return func(m *tailscale.Machine) bool {
+			dnsName := strings.TrimSuffix(m.DNSName, ".")
+			short, _, _ := strings.Cut(dnsName, ".")
+			return glob(pattern, m.HostName) || glob(pattern, dnsName) || glob(pattern, short)
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown selector key %q in %q", key, term)
+	}
+}
+
+func glob(pattern, s string) bool {
+	ok, _ := path.Match(pattern, strings.ToLower(s))
+	return ok
+}
@@ -0,0 +1,121 @@
+package fleet
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const fileExt = ".json"
+
+var validID = regexp.MustCompile(`^[0-9TZ]+-[0-9a-f]{8}$`)
+
+// ErrNotFound is returned for unknown or malformed run IDs.
+var ErrNotFound = errors.New("run not found")
+
+// Store keeps finished runs as JSON files in a single directory.
+type Store struct {
+	dir string
+}
+
+func NewStore(dir string) *Store {
+	return &Store{dir: dir}
+}
+
+// Save writes run, replacing any earlier copy.
+func (s *Store) Save(run *Run) error {
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return fmt.Errorf("failed to create runs directory: %w", err)
+	}
+
+	data, err := json.Marshal(run)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a crash never leaves a truncated
+	// run behind.
+	tmp := s.path(run.ID) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write run: %w", err)
+	}
+	if err := os.Rename(tmp, s.path(run.ID)); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write run: %w", err)
+	}
+	return nil
+}
+
+// Get loads a single run.
+func (s *Store) Get(id string) (*Run, error) {
+	if !validID.MatchString(id) {
+		return nil, ErrNotFound
+	}
+	data, err := os.ReadFile(s.path(id))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var run Run
+	if err := json.Unmarshal(data, &run); err != nil {
+		return nil, fmt.Errorf("invalid run %s: %w", id, err)
+	}
+	return &run, nil
+}
+
+// List returns all stored runs without their per-host results, newest
+// first.
+func (s *Store) List() ([]Run, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []Run{}, nil
+		}
+		return nil, err
+	}
+
+	runs := []Run{}
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), fileExt)
+		if !ok || !validID.MatchString(id) {
+			continue
+		}
+		run, err := s.Get(id)
+		if err != nil {
+			continue
+		}
+		runs = append(runs, run.brief())
+	}
+
+	sortRuns(runs)
+	return runs, nil
+}
+
+func (s *Store) path(id string) string {
+	return filepath.Join(s.dir, id+fileExt)
+}
+
+func sortRuns(runs []Run) {
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[i].StartedAt.After(runs[j].StartedAt)
+	})
+}
+
+func newID(t time.Time) (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return t.UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(b), nil
+}
@@ -0,0 +1,458 @@
+package forward
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rajsinghtech/tailtunnel/internal/audit"
+	"github.com/rajsinghtech/tailtunnel/internal/identity"
+)
+
+const (
+	defaultTTL = time.Hour
+	maxTTL     = 24 * time.Hour
+
+	// Forwards listen on ports in this range, the first free one unless
+	// the request names one. Ports outside it belong to TailTunnel itself
+	// or to services callers shouldn't be able to impersonate.
+	firstAutoPort = 10000
+	lastAutoPort  = 10999
+
+	// maxPerIdentity caps the forwards one identity may hold at once, so
+	// nobody can take the whole port range.
+	maxPerIdentity = 10
+
+	dialTimeout = 30 * time.Second
+)
+
+// ErrNotFound is returned for unknown forward IDs.
+var ErrNotFound = errors.New("forward not found")
+
+// Request describes a forward to create. Connections to ListenPort on
+// TailTunnel's tailnet address are forwarded over SSH to Host:Port as seen
+// from Machine.
+type Request struct {
+	Name       string `json:"name"`
+	Machine    string `json:"machine"`
+	User       string `json:"user,omitempty"`
+	Host       string `json:"host,omitempty"`
+	Port       int    `json:"port"`
+	ListenPort int    `json:"listenPort,omitempty"`
+
+	// TTL is a Go duration after which the forward is closed. Defaults to
+	// one hour.
+	TTL string `json:"ttl,omitempty"`
+}
+
+// Forward describes an active forward.
+type Forward struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Identity    string    `json:"identity"`
+	Machine     string    `json:"machine"`
+	User        string    `json:"user"`
+	Target      string    `json:"target"`
+	ListenPort  int       `json:"listenPort"`
+	Address     string    `json:"address"`
+	CreatedAt   time.Time `json:"createdAt"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+	Active      int64     `json:"active"`
+	Connections int64     `json:"connections"`
+	BytesIn     int64     `json:"bytesIn"`
+	BytesOut    int64     `json:"bytesOut"`
+}
+
+// DialFunc opens a connection to addr as seen from machine over SSH as
+// user, on behalf of the caller in ctx. It matches
+// (*ssh.SSHHandler).DialForward.
+type DialFunc func(ctx context.Context, machine, user, addr string) (net.Conn, error)
+
+// Manager owns the named forwards TailTunnel exposes on its own tailnet
+// address. Only the identity that created a forward may connect through it.
+type Manager struct {
+	listen   func(port int) (net.Listener, error)
+	dial     DialFunc
+	identify func(ctx context.Context, remoteAddr string) (*identity.Identity, error)
+	selfName func(ctx context.Context) (string, error)
+	audit    *audit.Logger
+
+	mu       sync.Mutex
+	forwards map[string]*forward
+}
+
+func NewManager(
+	listen func(port int) (net.Listener, error),
+	dial DialFunc,
+	identify func(ctx context.Context, remoteAddr string) (*identity.Identity, error),
+	selfName func(ctx context.Context) (string, error),
+	audit *audit.Logger,
+) *Manager {
+	return &Manager{
+		listen:   listen,
+		dial:     dial,
+		identify: identify,
+		selfName: selfName,
+		audit:    audit,
+		forwards: make(map[string]*forward),
+	}
+}
+
+type forward struct {
+	info     Forward
+	owner    *identity.Identity
+	ln       net.Listener
+	expiry   *time.Timer
+	active   atomic.Int64
+	total    atomic.Int64
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+}
+
+func (f *forward) snapshot() Forward {
+	info := f.info
+	info.Active = f.active.Load()
+	info.Connections = f.total.Load()
+	info.BytesIn = f.bytesIn.Load()
+	info.BytesOut = f.bytesOut.Load()
+	return info
+}
+
+// Create checks that the caller in ctx can reach the target, then starts
+// listening on the tailnet.
+func (m *Manager) Create(ctx context.Context, req Request) (*Forward, error) {
+	if req.Machine == "" {
+		return nil, errors.New("machine is required")
+	}
+	if req.Port < 1 || req.Port > 65535 {
+		return nil, fmt.Errorf("invalid port %d", req.Port)
+	}
+	if req.ListenPort != 0 && (req.ListenPort < firstAutoPort || req.ListenPort > lastAutoPort) {
+		return nil, fmt.Errorf("listen port %d is outside %d-%d", req.ListenPort, firstAutoPort, lastAutoPort)
+	}
+	if req.User == "" {
+		req.User = "root"
+	}
+	if req.Host == "" {
+		req.Host = "localhost"
+	}
+	ttl := defaultTTL
+	if req.TTL != "" {
+		d, err := time.ParseDuration(req.TTL)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid ttl %q", req.TTL)
+		}
+		if d > maxTTL {
+			return nil, fmt.Errorf("ttl %q exceeds the maximum of %s", req.TTL, maxTTL)
+		}
+		ttl = d
+	}
+
+	owner := identity.FromContext(ctx)
+	if owner == nil {
+		return nil, errors.New("caller could not be identified")
+	}
+	if err := m.checkLimit(owner); err != nil {
+		return nil, err
+	}
+	target := net.JoinHostPort(req.Host, strconv.Itoa(req.Port))
+
+	// Make one connection up front so policy and reachability errors are
+	// reported now rather than on first use.
+	dialCtx, cancel := context.WithTimeout(ctx, dialTimeout)
+	probe, err := m.dial(dialCtx, req.Machine, req.User, target)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	probe.Close()
+
+	ln, port, err := m.listenOn(req.ListenPort)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := newID()
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	address := ":" + strconv.Itoa(port)
+	if name, err := m.selfName(ctx); err == nil {
+		address = net.JoinHostPort(name, strconv.Itoa(port))
+	}
+
+	name := req.Name
+	if name == "" {
+		name = fmt.Sprintf("%s-%d", strings.SplitN(req.Machine, ".", 2)[0], req.Port)
+	}
+
+	now := time.Now()
+	f := &forward{
+		info: Forward{
+			ID:         id,
+			Name:       name,
+			Identity:   owner.OwnerName(),
+			Machine:    req.Machine,
+			User:       req.User,
+			Target:     target,
+			ListenPort: port,
+			Address:    address,
+			CreatedAt:  now,
+			ExpiresAt:  now.Add(ttl),
+		},
+		owner: owner,
+		ln:    ln,
+		conns: make(map[net.Conn]struct{}),
+	}
+
+	// Check again now that the forward is ready, since the caller may have
+	// created others while the probe was dialing.
+	m.mu.Lock()
+	if err := m.checkLimitLocked(owner); err != nil {
+		m.mu.Unlock()
+		ln.Close()
+		return nil, err
+	}
+	m.forwards[id] = f
+	f.expiry = time.AfterFunc(ttl, func() {
+		m.close(id, "expired")
+	})
+	m.mu.Unlock()
+
+	go m.serve(f)
+
+	ev := audit.NewEvent(ctx, audit.ActionForwardCreate)
+	ev.Outcome = audit.OutcomeSuccess
+	ev.Machine = req.Machine
+	ev.RemoteUser = req.User
+	ev.Details = map[string]any{"forward": id, "name": name, "target": target, "listenPort": port, "ttl": ttl.String()}
+	m.audit.Log(ev)
+
+	log.Printf("Forwarding %s to %s via %s for %s", address, target, req.Machine, ttl)
+
+	info := f.snapshot()
+	return &info, nil
+}
+
+// checkLimit returns an error if owner already holds maxPerIdentity
+// forwards.
+func (m *Manager) checkLimit(owner *identity.Identity) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.checkLimitLocked(owner)
+}
+
+func (m *Manager) checkLimitLocked(owner *identity.Identity) error {
+	n := 0
+	for _, f := range m.forwards {
+		if f.owner.OwnerName() == owner.OwnerName() {
+			n++
+		}
+	}
+	if n >= maxPerIdentity {
+		return fmt.Errorf("%s already has %d forwards, the maximum", owner.OwnerName(), n)
+	}
+	return nil
+}
+
+func (m *Manager) listenOn(port int) (net.Listener, int, error) {
+	if port != 0 {
+		ln, err := m.listen(port)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to listen on port %d: %w", port, err)
+		}
+		return ln, port, nil
+	}
+
+	for p := firstAutoPort; p <= lastAutoPort; p++ {
+		if ln, err := m.listen(p); err == nil {
+			return ln, p, nil
+		}
+	}
+	return nil, 0, fmt.Errorf("no free port between %d and %d", firstAutoPort, lastAutoPort)
+}
+
+func (m *Manager) serve(f *forward) {
+	for {
+		conn, err := f.ln.Accept()
+		if err != nil {
+			return
+		}
+		go m.handle(f, conn)
+	}
+}
+
+func (m *Manager) handle(f *forward, conn net.Conn) {
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	caller, err := m.identify(ctx, conn.RemoteAddr().String())
+	cancel()
+	if err != nil || caller.OwnerName() != f.owner.OwnerName() {
+		who := conn.RemoteAddr().String()
+		if caller != nil {
+			who = caller.OwnerName()
+		}
+		log.Printf("Refusing connection to forward %s from %s", f.info.ID, who)
+		ev := audit.NewEvent(identity.NewContext(context.Background(), caller), audit.ActionForwardConnect)
+		ev.Outcome = audit.OutcomeDenied
+		ev.Machine = f.info.Machine
+		ev.Reason = "only the creator of a forward may use it"
+		ev.Details = map[string]any{"forward": f.info.ID, "remoteAddr": conn.RemoteAddr().String()}
+		m.audit.Log(ev)
+		return
+	}
+
+	if !f.track(conn) {
+		return
+	}
+	defer f.untrack(conn)
+
+	// Authorize as the connecting node so policy changes since the forward
+	// was created still apply.
+	ctx, cancel = context.WithTimeout(identity.NewContext(context.Background(), caller), dialTimeout)
+	target, err := m.dial(ctx, f.info.Machine, f.info.User, f.info.Target)
+	cancel()
+	if err != nil {
+		log.Printf("Forward %s failed to reach %s: %v", f.info.ID, f.info.Target, err)
+		return
+	}
+	defer target.Close()
+
+	f.active.Add(1)
+	f.total.Add(1)
+	defer f.active.Add(-1)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		n, _ := io.Copy(target, conn)
+		f.bytesIn.Add(n)
+		target.Close()
+	}()
+	go func() {
+		defer wg.Done()
+		n, _ := io.Copy(conn, target)
+		f.bytesOut.Add(n)
+		conn.Close()
+	}()
+	wg.Wait()
+}
+
+// track registers conn so closing the forward also closes it. It reports
+// false if the forward is already closed.
+func (f *forward) track(conn net.Conn) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return false
+	}
+	f.conns[conn] = struct{}{}
+	return true
+}
+
+func (f *forward) untrack(conn net.Conn) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.conns, conn)
+}
+
+// List returns the active forwards, soonest to expire first.
+func (m *Manager) List() []Forward {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	forwards := make([]Forward, 0, len(m.forwards))
+	for _, f := range m.forwards {
+		forwards = append(forwards, f.snapshot())
+	}
+	sort.Slice(forwards, func(i, j int) bool {
+		return forwards[i].ExpiresAt.Before(forwards[j].ExpiresAt)
+	})
+	return forwards
+}
+
+// Get returns a single active forward.
+func (m *Manager) Get(id string) (*Forward, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, ok := m.forwards[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	info := f.snapshot()
+	return &info, nil
+}
+
+// Close stops a forward and drops its open connections.
+func (m *Manager) Close(id string) error {
+	if !m.close(id, "closed") {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (m *Manager) close(id, reason string) bool {
+	m.mu.Lock()
+	f, ok := m.forwards[id]
+	delete(m.forwards, id)
+	m.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	f.expiry.Stop()
+	f.ln.Close()
+
+	f.mu.Lock()
+	f.closed = true
+	for conn := range f.conns {
+		conn.Close()
+	}
+	f.mu.Unlock()
+
+	info := f.snapshot()
+	ev := audit.NewEvent(identity.NewContext(context.Background(), f.owner), audit.ActionForwardClose)
+	ev.Outcome = audit.OutcomeSuccess
+	ev.Machine = info.Machine
+	ev.RemoteUser = info.User
+	ev.Reason = reason
+	ev.Details = map[string]any{
+		"forward":     id,
+		"target":      info.Target,
+		"connections": info.Connections,
+		"bytesIn":     info.BytesIn,
+		"bytesOut":    info.BytesOut,
+	}
+	m.audit.Log(ev)
+
+	log.Printf("Forward %s (%s) %s", id, info.Name, reason)
+	return true
+}
+
+func newID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,75 @@
+package forward
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rajsinghtech/tailtunnel/internal/identity"
+	"github.com/rajsinghtech/tailtunnel/internal/policy"
+)
+
+// Handler serves the forward API. Callers only see and close their own
+// forwards.
+type Handler struct {
+	manager *Manager
+}
+
+func NewHandler(manager *Manager) *Handler {
+	return &Handler{manager: manager}
+}
+
+func (h *Handler) List(w http.ResponseWriter, r *http.Request) {
+	caller := identity.OwnerName(r.Context())
+	mine := []Forward{}
+	for _, f := range h.manager.List() {
+		if f.Identity == caller {
+			mine = append(mine, f)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(mine)
+}
+
+// Create starts a forward from the JSON-encoded Request in the body.
+func (h *Handler) Create(w http.ResponseWriter, r *http.Request) {
+	var req Request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	f, err := h.manager.Create(r.Context(), req)
+	if err != nil {
+		log.Printf("Failed to create forward: %v", err)
+		status := http.StatusBadRequest
+		var denied *policy.DeniedError
+		if errors.As(err, &denied) {
+			status = http.StatusForbidden
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(f)
+}
+
+func (h *Handler) Close(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	f, err := h.manager.Get(id)
+	if err != nil || f.Identity != identity.OwnerName(r.Context()) {
+		http.Error(w, ErrNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	if err := h.manager.Close(id); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
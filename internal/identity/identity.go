@@ -0,0 +1,164 @@
+package identity
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"tailscale.com/client/tailscale"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+// Identity describes the tailnet user and node behind a request, as resolved
+// by LocalClient.WhoIs.
+type Identity struct {
+	LoginName     string             `json:"loginName"`
+	DisplayName   string             `json:"displayName"`
+	ProfilePicURL string             `json:"profilePicUrl,omitempty"`
+	NodeName      string             `json:"nodeName"`
+	NodeID        string             `json:"nodeId"`
+	Tags          []string           `json:"tags,omitempty"`
+	Addresses     []string           `json:"addresses"`
+	Capabilities  tailcfg.PeerCapMap `json:"capabilities,omitempty"`
+}
+
+// IsTagged reports whether the caller is a tagged node rather than a user.
+func (id *Identity) IsTagged() bool {
+	return len(id.Tags) > 0
+}
+
+// OwnerName names the caller as the owner of sessions, forwards and other
+// resources. Tagged nodes all share one login name, so they are told apart
+// by node name.
+func (id *Identity) OwnerName() string {
+	if id.IsTagged() {
+		return id.NodeName
+	}
+	return id.LoginName
+}
+
+// HasCap reports whether the caller was granted the given peer capability.
+func (id *Identity) HasCap(capability tailcfg.PeerCapability) bool {
+	_, ok := id.Capabilities[capability]
+	return ok
+}
+
+func fromWhoIs(who *apitype.WhoIsResponse) *Identity {
+	id := &Identity{
+		Capabilities: who.CapMap,
+	}
+
+	if who.UserProfile != nil {
+		id.LoginName = who.UserProfile.LoginName
+		id.DisplayName = who.UserProfile.DisplayName
+		id.ProfilePicURL = who.UserProfile.ProfilePicURL
+	}
+
+	if node := who.Node; node != nil {
+		id.NodeName = strings.TrimSuffix(node.Name, ".")
+		id.NodeID = string(node.StableID)
+		id.Tags = node.Tags
+		for _, addr := range node.Addresses {
+			id.Addresses = append(id.Addresses, addr.Addr().String())
+		}
+	}
+
+	return id
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying id.
+func NewContext(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the identity attached by Middleware, or nil.
+func FromContext(ctx context.Context) *Identity {
+	id, _ := ctx.Value(contextKey{}).(*Identity)
+	return id
+}
+
+// LoginName returns the login name of the caller in ctx, or "" if the
+// caller is unknown.
+func LoginName(ctx context.Context) string {
+	if id := FromContext(ctx); id != nil {
+		return id.LoginName
+	}
+	return ""
+}
+
+// OwnerName returns Identity.OwnerName for the caller in ctx, or "" if the
+// caller is unknown.
+func OwnerName(ctx context.Context) string {
+	if id := FromContext(ctx); id != nil {
+		return id.OwnerName()
+	}
+	return ""
+}
+
+// WhoIs identifies the tailnet node and user behind remoteAddr, for
+// connections that don't arrive over HTTP.
+func WhoIs(ctx context.Context, lc *tailscale.LocalClient, remoteAddr string) (*Identity, error) {
+	who, err := lc.WhoIs(ctx, remoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	return fromWhoIs(who), nil
+}
+
+// Middleware resolves the caller of every request with WhoIs and attaches
+// the result to the request context. Requests that can't be attributed to a
+// tailnet node are rejected.
+func Middleware(lc *tailscale.LocalClient) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id, err := WhoIs(r.Context(), lc, r.RemoteAddr)
+			if err != nil {
+				log.Printf("Failed to identify caller %s: %v", r.RemoteAddr, err)
+				http.Error(w, "unable to identify tailnet caller", http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), id)))
+		})
+	}
+}
+
+// SameOrigin reports whether r was sent by TailTunnel's own pages or by a
+// non-browser client. Callers are identified by their tailnet address
+// alone, so any page open in a tailnet user's browser could otherwise send
+// requests as that user.
+func SameOrigin(r *http.Request) bool {
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "same-origin", "none":
+		return true
+	case "":
+	default:
+		return false
+	}
+
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		// Browsers send Origin on every cross-origin POST and websocket,
+		// so its absence means a same-origin GET or a non-browser client.
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// RequireSameOrigin rejects requests that SameOrigin doesn't allow.
+func RequireSameOrigin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !SameOrigin(r) {
+			log.Printf("Rejected cross-site %s %s from %s (Origin %q, Referer %q)", r.Method, r.URL.Path, r.RemoteAddr, r.Header.Get("Origin"), r.Header.Get("Referer"))
+			http.Error(w, "cross-site requests are not allowed", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
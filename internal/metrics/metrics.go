@@ -0,0 +1,276 @@
+package metrics
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rajsinghtech/tailtunnel/internal/canary"
+)
+
+// peerLabels identify a peer. They are kept to the hostname, first tag and
+// OS so a tailnet's worth of peers stays a manageable number of series.
+var peerLabels = []string{"host", "tag", "os"}
+
+// connectionTypes are the values of the type label of
+// tailtunnel_peer_connection_type. Exactly one is 1 for each peer.
+var connectionTypes = []canary.ConnectionType{
+	canary.ConnectionDirect,
+	canary.ConnectionDERP,
+	canary.ConnectionPeerRelay,
+	canary.ConnectionOffline,
+	canary.ConnectionUnknown,
+}
+
+// SessionCounter reports the number of live SSH sessions.
+type SessionCounter interface {
+	ActiveSessions() (browser, gateway int)
+}
+
+// Metrics exports canary results, peer traffic, SSH sessions and HTTP
+// latencies in the Prometheus format.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	pingLatency    *prometheus.HistogramVec
+	pings          *prometheus.CounterVec
+	connectionType *prometheus.GaugeVec
+	httpDuration   *prometheus.HistogramVec
+
+	// peers are the label values of the peers seen in the last round, so
+	// series of peers that leave the tailnet can be deleted.
+	peers map[string]prometheus.Labels
+}
+
+// New returns Metrics reading peer traffic from pinger and session counts
+// from sessions at scrape time.
+func New(pinger *canary.Pinger, sessions SessionCounter) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		pingLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "tailtunnel_canary_ping_latency_seconds",
+			Help:    "Latency of successful scheduled canary pings.",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 13),
+		}, peerLabels),
+		pings: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tailtunnel_canary_pings_total",
+			Help: "Scheduled canary pings by result (success or failure).",
+		}, append(slices.Clone(peerLabels), "result")),
+		connectionType: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "tailtunnel_peer_connection_type",
+			Help: "1 for the path the last canary ping to the peer took, 0 for the others.",
+		}, append(slices.Clone(peerLabels), "type")),
+		httpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "tailtunnel_http_request_duration_seconds",
+			Help:    "Latency of HTTP requests by route pattern.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "route", "code"}),
+		peers: make(map[string]prometheus.Labels),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.pingLatency,
+		m.pings,
+		m.connectionType,
+		m.httpDuration,
+		&peerCollector{pinger: pinger},
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "tailtunnel_ssh_sessions_active",
+			Help:        "Live SSH sessions.",
+			ConstLabels: prometheus.Labels{"via": "browser"},
+		}, func() float64 {
+			browser, _ := sessions.ActiveSessions()
+			return float64(browser)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "tailtunnel_ssh_sessions_active",
+			Help:        "Live SSH sessions.",
+			ConstLabels: prometheus.Labels{"via": "gateway"},
+		}, func() float64 {
+			_, gateway := sessions.ActiveSessions()
+			return float64(gateway)
+		}),
+	)
+
+	return m
+}
+
+// ObserveRound records the results of a round of scheduled canary pings.
+// It is registered with canary.Scheduler.OnRound, which calls it from a
+// single goroutine.
+func (m *Metrics) ObserveRound(round canary.Round) {
+	seen := make(map[string]bool, len(round.Peers))
+	for i, peer := range round.Peers {
+		sample := round.Samples[i]
+		labels := labelsFor(peer)
+		seen[peer.IP] = true
+
+		// A peer whose hostname, tag or OS changed starts new series.
+		old, changed := m.peers[peer.IP]
+		m.peers[peer.IP] = labels
+		if changed && !sameLabels(old, labels) {
+			m.release(old)
+		}
+
+		result := "failure"
+		if sample.Success {
+			result = "success"
+			m.pingLatency.With(labels).Observe(sample.LatencyMs / 1000)
+		}
+		m.pings.With(withLabel(labels, "result", result)).Inc()
+
+		for _, t := range connectionTypes {
+			value := 0.0
+			if t == sample.ConnectionType {
+				value = 1
+			}
+			m.connectionType.With(withLabel(labels, "type", string(t))).Set(value)
+		}
+	}
+
+	for ip, labels := range m.peers {
+		if !seen[ip] {
+			delete(m.peers, ip)
+			m.release(labels)
+		}
+	}
+}
+
+// release deletes the series for labels once no peer maps to them. Peers
+// sharing a hostname, tag and OS share series, so one leaving mustn't take
+// the others' with it.
+func (m *Metrics) release(labels prometheus.Labels) {
+	for _, l := range m.peers {
+		if sameLabels(l, labels) {
+			return
+		}
+	}
+	m.deletePeer(labels)
+}
+
+func (m *Metrics) deletePeer(labels prometheus.Labels) {
+	m.pingLatency.DeletePartialMatch(labels)
+	m.pings.DeletePartialMatch(labels)
+	m.connectionType.DeletePartialMatch(labels)
+}
+
+// Middleware records the latency of every request, labeled by its chi
+// route pattern rather than its path so the label stays bounded.
+func (m *Metrics) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil {
+			if pattern := rctx.RoutePattern(); pattern != "" {
+				route = pattern
+			}
+		}
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		m.httpDuration.WithLabelValues(r.Method, route, strconv.Itoa(status)).Observe(time.Since(start).Seconds())
+	})
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// peerCollector reads each peer's traffic counters from tailscaled when
+// scraped, so they are as fresh as the scrape rather than the last round.
+type peerCollector struct {
+	pinger *canary.Pinger
+}
+
+var (
+	rxBytesDesc = prometheus.NewDesc(
+		"tailtunnel_peer_rx_bytes_total",
+		"Bytes received from the peer over WireGuard.",
+		peerLabels, nil,
+	)
+	txBytesDesc = prometheus.NewDesc(
+		"tailtunnel_peer_tx_bytes_total",
+		"Bytes sent to the peer over WireGuard.",
+		peerLabels, nil,
+	)
+)
+
+func (c *peerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- rxBytesDesc
+	ch <- txBytesDesc
+}
+
+func (c *peerCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	peers, err := c.pinger.GetPeers(ctx)
+	if err != nil {
+		log.Printf("Metrics: failed to list peers: %v", err)
+		return
+	}
+
+	// Peers sharing a hostname, tag and OS would otherwise be reported as
+	// duplicate series, which fails the whole scrape.
+	type key struct{ host, tag, os string }
+	rx := make(map[key]int64)
+	tx := make(map[key]int64)
+	for _, peer := range peers.Peers {
+		l := labelsFor(peer)
+		k := key{l["host"], l["tag"], l["os"]}
+		rx[k] += peer.RxBytes
+		tx[k] += peer.TxBytes
+	}
+	for k, n := range rx {
+		ch <- prometheus.MustNewConstMetric(rxBytesDesc, prometheus.CounterValue, float64(n), k.host, k.tag, k.os)
+		ch <- prometheus.MustNewConstMetric(txBytesDesc, prometheus.CounterValue, float64(tx[k]), k.host, k.tag, k.os)
+	}
+}
+
+// labelsFor returns the peer labels of peer. Only the first of a peer's
+// tags, in sorted order, is used.
+func labelsFor(peer canary.PeerInfo) prometheus.Labels {
+	tag := ""
+	if len(peer.Tags) > 0 {
+		tags := slices.Clone(peer.Tags)
+		slices.Sort(tags)
+		tag = tags[0]
+	}
+	return prometheus.Labels{"host": peer.HostName, "tag": tag, "os": peer.OS}
+}
+
+func withLabel(labels prometheus.Labels, name, value string) prometheus.Labels {
+	l := make(prometheus.Labels, len(labels)+1)
+	for k, v := range labels {
+		l[k] = v
+	}
+	l[name] = value
+	return l
+}
+
+func sameLabels(a, b prometheus.Labels) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,433 @@
+package policy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rajsinghtech/tailtunnel/internal/identity"
+	"github.com/rajsinghtech/tailtunnel/internal/tailscale"
+	"tailscale.com/tailcfg"
+)
+
+// CapSSH is the peer capability that grants SSH access through TailTunnel.
+// It is granted in the tailnet policy file, for example:
+//
+//	"grants": [{
+//	  "src": ["group:sre"],
+//	  "dst": ["tag:tailtunnel"],
+//	  "app": {"tailtunnel/cap/ssh": [{"dst": ["tag:prod"], "users": ["ubuntu"]}]}
+//	}]
+const CapSSH tailcfg.PeerCapability = "tailtunnel/cap/ssh"
+
+// CapTCP is the peer capability that grants TCP tunnels to arbitrary ports
+// through TailTunnel. Its values are PortRules.
+const CapTCP tailcfg.PeerCapability = "tailtunnel/cap/tcp"
+
+// CapAdmin is the peer capability that makes its holders TailTunnel admins,
+// who manage stored keys and alert silences and can read every recording
+// and audit event. Its value is ignored.
+const CapAdmin tailcfg.PeerCapability = "tailtunnel/cap/admin"
+
+// CapAuditor is the peer capability that lets its holders read every
+// recording and audit event. Its value is ignored.
+const CapAuditor tailcfg.PeerCapability = "tailtunnel/cap/auditor"
+
+// Rule allows callers matching Src to log in to machines matching Dst as any
+// of Users. Src is only used in the policy file; rules granted through
+// CapSSH apply to whoever holds the capability.
+//
+// Src entries are login names (globs such as "*@example.com" are allowed),
+// "group:<name>" from the policy file, "tag:<name>" or "*". Dst entries are
+// hostnames, MagicDNS names, Tailscale IPs, "tag:<name>" or "*". Users are
+// remote usernames, "*" for any, or "localpart" for the caller's login name
+// up to the "@".
+//
+// AgentForwarding and UserRC let certificates issued by the SSH CA for
+// these logins permit agent forwarding and ~/.ssh/rc.
+type Rule struct {
+	Src             []string `json:"src,omitempty"`
+	Dst             []string `json:"dst"`
+	Users           []string `json:"users"`
+	AgentForwarding bool     `json:"agentForwarding,omitempty"`
+	UserRC          bool     `json:"userRC,omitempty"`
+}
+
+// CertGrant is what an SSH certificate for a login may carry.
+type CertGrant struct {
+	Principals      []string
+	AgentForwarding bool
+	UserRC          bool
+}
+
+// PortRule allows callers matching Src to open TCP connections to Ports on
+// machines matching Dst. Src and Dst work as in Rule. Ports are single
+// ports ("5900"), ranges ("8000-8100") or "*".
+type PortRule struct {
+	Src   []string `json:"src,omitempty"`
+	Dst   []string `json:"dst"`
+	Ports []string `json:"ports"`
+}
+
+// File is the on-disk policy format. Admins and Auditors use the syntax of
+// Rule.Src and grant the same as CapAdmin and CapAuditor.
+type File struct {
+	Groups   map[string][]string `json:"groups,omitempty"`
+	SSH      []Rule              `json:"ssh"`
+	TCP      []PortRule          `json:"tcp,omitempty"`
+	Admins   []string            `json:"admins,omitempty"`
+	Auditors []string            `json:"auditors,omitempty"`
+}
+
+// DeniedError is returned when the policy does not allow a request.
+type DeniedError struct {
+	Reason string
+}
+
+func (e *DeniedError) Error() string {
+	return "access denied: " + e.Reason
+}
+
+// Engine evaluates the policy file together with capabilities granted
+// through tailnet ACLs. The file is reloaded when it changes on disk.
+type Engine struct {
+	path          string
+	enforce       bool
+	lookupMachine func(ctx context.Context, machine string) (*tailscale.Machine, error)
+
+	mu      sync.Mutex
+	file    *File
+	modTime time.Time
+}
+
+// NewEngine returns an engine reading rules from path. When enforce is false
+// every request is allowed, which matches TailTunnel's behavior before
+// policies existed.
+func NewEngine(path string, enforce bool, lookupMachine func(ctx context.Context, machine string) (*tailscale.Machine, error)) *Engine {
+	e := &Engine{
+		path:          path,
+		enforce:       enforce,
+		lookupMachine: lookupMachine,
+		file:          &File{},
+	}
+	e.reload()
+	return e
+}
+
+func (e *Engine) reload() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	stat, err := os.Stat(e.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to stat policy file %s: %v", e.path, err)
+		}
+		return
+	}
+	if stat.ModTime().Equal(e.modTime) {
+		return
+	}
+
+	data, err := os.ReadFile(e.path)
+	if err != nil {
+		log.Printf("Failed to read policy file %s: %v", e.path, err)
+		return
+	}
+
+	var f File
+	if err := json.Unmarshal(data, &f); err != nil {
+		// Keep the last good policy; if there is none, nothing is allowed.
+		log.Printf("Failed to parse policy file %s: %v", e.path, err)
+		return
+	}
+
+	e.file = &f
+	e.modTime = stat.ModTime()
+	log.Printf("Loaded policy from %s (%d SSH rules, %d TCP rules)", e.path, len(f.SSH), len(f.TCP))
+}
+
+// AuthorizeSSH decides whether caller may open an SSH session to machine as
+// user. It returns a *DeniedError explaining why if not.
+func (e *Engine) AuthorizeSSH(ctx context.Context, caller *identity.Identity, machine, user string) error {
+	if !e.enforce {
+		return nil
+	}
+	if caller == nil {
+		return &DeniedError{Reason: "caller could not be identified"}
+	}
+
+	target, err := e.lookupMachine(ctx, machine)
+	if err != nil {
+		return &DeniedError{Reason: fmt.Sprintf("unknown machine %q", machine)}
+	}
+
+	rules := e.rulesFor(caller)
+	if len(rules) == 0 {
+		return &DeniedError{Reason: fmt.Sprintf("no policy rule grants %s SSH access through TailTunnel", callerName(caller))}
+	}
+
+	dstAllowed := false
+	for _, rule := range rules {
+		if !MatchesMachine(rule.Dst, target) {
+			continue
+		}
+		dstAllowed = true
+		if matchesUser(rule.Users, user, caller) {
+			return nil
+		}
+	}
+
+	if dstAllowed {
+		return &DeniedError{Reason: fmt.Sprintf("%s may not log in to %s as %q", callerName(caller), machine, user)}
+	}
+	return &DeniedError{Reason: fmt.Sprintf("%s may not SSH to %s", callerName(caller), machine)}
+}
+
+// Enforced reports whether the policy is enforced rather than allowing
+// every request.
+func (e *Engine) Enforced() bool {
+	return e.enforce
+}
+
+// GrantCert decides what a certificate letting caller log in to machine as
+// user may carry. Its only principal is user, and only if the policy allows
+// the login; certificates are never issued while the policy isn't enforced.
+func (e *Engine) GrantCert(ctx context.Context, caller *identity.Identity, machine, user string) (*CertGrant, error) {
+	if !e.enforce {
+		return nil, &DeniedError{Reason: "certificates are only issued under an enforced policy"}
+	}
+	if err := e.AuthorizeSSH(ctx, caller, machine, user); err != nil {
+		return nil, err
+	}
+	target, err := e.lookupMachine(ctx, machine)
+	if err != nil {
+		return nil, &DeniedError{Reason: fmt.Sprintf("unknown machine %q", machine)}
+	}
+
+	grant := &CertGrant{Principals: []string{user}}
+	for _, rule := range e.rulesFor(caller) {
+		if MatchesMachine(rule.Dst, target) && matchesUser(rule.Users, user, caller) {
+			grant.AgentForwarding = grant.AgentForwarding || rule.AgentForwarding
+			grant.UserRC = grant.UserRC || rule.UserRC
+		}
+	}
+	return grant, nil
+}
+
+// AuthorizePort decides whether caller may open a TCP connection to port on
+// machine. It returns a *DeniedError explaining why if not.
+func (e *Engine) AuthorizePort(ctx context.Context, caller *identity.Identity, machine string, port int) error {
+	if !e.enforce {
+		return nil
+	}
+	if caller == nil {
+		return &DeniedError{Reason: "caller could not be identified"}
+	}
+
+	target, err := e.lookupMachine(ctx, machine)
+	if err != nil {
+		return &DeniedError{Reason: fmt.Sprintf("unknown machine %q", machine)}
+	}
+
+	rules := e.portRulesFor(caller)
+	if len(rules) == 0 {
+		return &DeniedError{Reason: fmt.Sprintf("no policy rule grants %s TCP access through TailTunnel", callerName(caller))}
+	}
+
+	for _, rule := range rules {
+		if MatchesMachine(rule.Dst, target) && matchesPort(rule.Ports, port) {
+			return nil
+		}
+	}
+	return &DeniedError{Reason: fmt.Sprintf("%s may not connect to port %d on %s", callerName(caller), port, machine)}
+}
+
+// IsAdmin reports whether caller is a TailTunnel admin. Unlike SSH and TCP
+// access this is never granted to everyone, even when the policy is not
+// enforced.
+func (e *Engine) IsAdmin(caller *identity.Identity) bool {
+	if caller == nil {
+		return false
+	}
+	file := e.current()
+	return caller.HasCap(CapAdmin) || matchesCaller(file.Admins, caller, file.Groups)
+}
+
+// IsAuditor reports whether caller may read every recording and audit
+// event, which admins also may.
+func (e *Engine) IsAuditor(caller *identity.Identity) bool {
+	if caller == nil {
+		return false
+	}
+	file := e.current()
+	return caller.HasCap(CapAuditor) || matchesCaller(file.Auditors, caller, file.Groups) || e.IsAdmin(caller)
+}
+
+// RequireAdmin is middleware that only lets admins through.
+func (e *Engine) RequireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !e.IsAdmin(identity.FromContext(r.Context())) {
+			http.Error(w, "Only TailTunnel admins may do this", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// current returns the policy file, reloading it first if it changed.
+func (e *Engine) current() *File {
+	e.reload()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.file
+}
+
+// rulesFor returns the rules that apply to caller: file rules whose Src
+// matches and every rule granted through CapSSH.
+func (e *Engine) rulesFor(caller *identity.Identity) []Rule {
+	file := e.current()
+
+	var rules []Rule
+	for _, rule := range file.SSH {
+		if matchesCaller(rule.Src, caller, file.Groups) {
+			rules = append(rules, rule)
+		}
+	}
+
+	granted, err := tailcfg.UnmarshalCapJSON[Rule](caller.Capabilities, CapSSH)
+	if err != nil {
+		log.Printf("Ignoring malformed %s capability for %s: %v", CapSSH, callerName(caller), err)
+	}
+	return append(rules, granted...)
+}
+
+// portRulesFor is rulesFor for TCP rules and CapTCP.
+func (e *Engine) portRulesFor(caller *identity.Identity) []PortRule {
+	file := e.current()
+
+	var rules []PortRule
+	for _, rule := range file.TCP {
+		if matchesCaller(rule.Src, caller, file.Groups) {
+			rules = append(rules, rule)
+		}
+	}
+
+	granted, err := tailcfg.UnmarshalCapJSON[PortRule](caller.Capabilities, CapTCP)
+	if err != nil {
+		log.Printf("Ignoring malformed %s capability for %s: %v", CapTCP, callerName(caller), err)
+	}
+	return append(rules, granted...)
+}
+
+func matchesCaller(src []string, caller *identity.Identity, groups map[string][]string) bool {
+	for _, s := range src {
+		switch {
+		case s == "*":
+			return true
+		case strings.HasPrefix(s, "group:"):
+			if matchesCaller(groups[s], caller, nil) {
+				return true
+			}
+		case strings.HasPrefix(s, "tag:"):
+			if hasTag(caller.Tags, s) {
+				return true
+			}
+		default:
+			if ok, _ := path.Match(strings.ToLower(s), strings.ToLower(caller.LoginName)); ok && caller.LoginName != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// MatchesMachine reports whether m matches any of dst, using the same
+// syntax as Rule.Dst.
+func MatchesMachine(dst []string, m *tailscale.Machine) bool {
+	dnsName := strings.ToLower(strings.TrimSuffix(m.DNSName, "."))
+	shortName, _, _ := strings.Cut(dnsName, ".")
+
+	for _, d := range dst {
+		d = strings.ToLower(strings.TrimSuffix(d, "."))
+		switch {
+		case d == "*":
+			return true
+		case strings.HasPrefix(d, "tag:"):
+			if hasTag(m.Tags, d) {
+				return true
+			}
+		case d == dnsName, d == shortName, d == strings.ToLower(m.HostName):
+			return true
+		default:
+			for _, ip := range m.TailscaleIPs {
+				if d == ip {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func matchesUser(users []string, user string, caller *identity.Identity) bool {
+	for _, u := range users {
+		switch u {
+		case "*":
+			return true
+		case "localpart":
+			local, _, _ := strings.Cut(caller.LoginName, "@")
+			if local != "" && local == user {
+				return true
+			}
+		default:
+			if u == user {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchesPort(ports []string, port int) bool {
+	for _, p := range ports {
+		if p == "*" {
+			return true
+		}
+		lo, hi, isRange := strings.Cut(p, "-")
+		if !isRange {
+			hi = lo
+		}
+		min, err1 := strconv.Atoi(strings.TrimSpace(lo))
+		max, err2 := strconv.Atoi(strings.TrimSpace(hi))
+		if err1 == nil && err2 == nil && port >= min && port <= max {
+			return true
+		}
+	}
+	return false
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+func callerName(caller *identity.Identity) string {
+	if caller.IsTagged() {
+		return strings.Join(caller.Tags, ",")
+	}
+	return caller.LoginName
+}
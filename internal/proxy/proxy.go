@@ -0,0 +1,197 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rajsinghtech/tailtunnel/internal/identity"
+	"github.com/rajsinghtech/tailtunnel/internal/policy"
+	"github.com/rajsinghtech/tailtunnel/internal/tunnel"
+)
+
+// Handler reverse proxies /proxy/{machine}/{port}/... to http://machine:port/...
+// over the tailnet, so web UIs on peers can be opened by anyone who can reach
+// TailTunnel. Redirects and cookies are rewritten to stay under the prefix,
+// and X-Forwarded-Prefix is set for apps that can serve from a sub-path.
+// Absolute links inside response bodies are not rewritten.
+//
+// The handler is meant to be served on a port of its own, so scripts in an
+// app have a different origin from TailTunnel's pages and can't call its API
+// as the person viewing the app. Apps still share that origin with each
+// other, and cookies ignore ports, which is why cookies are scoped by path.
+//
+// Peers trust requests made with the viewer's identity, so any request that
+// can change state must come from a page on the proxy's own origin; see
+// sameOriginOrSafe.
+type Handler struct {
+	// Authorizer, when set, is consulted for every request with the same
+	// port rules as TCP tunnels.
+	Authorizer tunnel.Authorizer
+
+	transport *http.Transport
+}
+
+// NewHandler returns a proxy that connects to peers with dial.
+func NewHandler(dial func(ctx context.Context, machine string, port int) (net.Conn, error), authorizer tunnel.Authorizer) *Handler {
+	return &Handler{
+		Authorizer: authorizer,
+		transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				host, portStr, err := net.SplitHostPort(addr)
+				if err != nil {
+					return nil, err
+				}
+				port, err := strconv.Atoi(portStr)
+				if err != nil {
+					return nil, err
+				}
+				return dial(ctx, host, port)
+			},
+			MaxIdleConnsPerHost:   4,
+			IdleConnTimeout:       90 * time.Second,
+			ResponseHeaderTimeout: time.Minute,
+		},
+	}
+}
+
+func (h *Handler) Proxy(w http.ResponseWriter, r *http.Request) {
+	machine := chi.URLParam(r, "machine")
+	port, err := strconv.Atoi(chi.URLParam(r, "port"))
+	if err != nil || port < 1 || port > 65535 {
+		http.Error(w, "invalid port", http.StatusBadRequest)
+		return
+	}
+
+	prefix := fmt.Sprintf("/proxy/%s/%d", machine, port)
+	rest := strings.TrimPrefix(r.URL.Path, prefix)
+	if rest == "" {
+		// Relative links in the app only resolve under the trailing slash.
+		target := prefix + "/"
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+		return
+	}
+
+	if !sameOriginOrSafe(r) {
+		log.Printf("Rejected cross-site %s %s from %s (Sec-Fetch-Site %q)", r.Method, r.URL.Path, r.RemoteAddr, r.Header.Get("Sec-Fetch-Site"))
+		http.Error(w, "cross-site requests are not allowed", http.StatusForbidden)
+		return
+	}
+
+	if h.Authorizer != nil {
+		if err := h.Authorizer.AuthorizePort(r.Context(), identity.FromContext(r.Context()), machine, port); err != nil {
+			reason := err.Error()
+			var denied *policy.DeniedError
+			if errors.As(err, &denied) {
+				reason = denied.Reason
+			}
+			http.Error(w, "Access denied: "+reason, http.StatusForbidden)
+			return
+		}
+	}
+
+	upstream := &url.URL{Scheme: "http", Host: net.JoinHostPort(machine, strconv.Itoa(port))}
+	rp := &httputil.ReverseProxy{
+		Transport: h.transport,
+		// Flush immediately so streaming responses aren't held back.
+		FlushInterval: -1,
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(upstream)
+			pr.Out.URL.Path = rest
+			pr.Out.URL.RawPath = ""
+			pr.SetXForwarded()
+			pr.Out.Header.Set("X-Forwarded-Prefix", prefix)
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			rewriteLocation(resp.Header, upstream, prefix)
+			rewriteCookies(resp.Header, prefix)
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("Proxy to %s failed: %v", upstream.Host, err)
+			http.Error(w, fmt.Sprintf("Failed to reach %s: %v", upstream.Host, err), http.StatusBadGateway)
+		},
+	}
+	rp.ServeHTTP(w, r)
+}
+
+// sameOriginOrSafe reports whether r may be proxied: plain GET, HEAD and
+// OPTIONS requests from anywhere, so links to an app keep working, and
+// anything else, websockets included, only with Sec-Fetch-Site set to
+// same-origin by the browser. The Referer can be suppressed by the sending
+// page and Origin is absent from some requests, so neither is enough here.
+// Non-browser clients have to send the header themselves.
+func sameOriginOrSafe(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		if r.Header.Get("Upgrade") == "" {
+			return true
+		}
+	}
+	return r.Header.Get("Sec-Fetch-Site") == "same-origin"
+}
+
+// rewriteLocation maps redirects to the upstream, whether absolute or
+// root-relative, back under prefix. Redirects elsewhere are left alone.
+func rewriteLocation(header http.Header, upstream *url.URL, prefix string) {
+	loc := header.Get("Location")
+	if loc == "" {
+		return
+	}
+	u, err := url.Parse(loc)
+	if err != nil {
+		return
+	}
+
+	switch {
+	case u.IsAbs():
+		if !strings.EqualFold(u.Host, upstream.Host) && !strings.EqualFold(u.Hostname(), upstream.Hostname()) {
+			return
+		}
+		u.Scheme = ""
+		u.Host = ""
+	case u.Host != "", !strings.HasPrefix(u.Path, "/"):
+		// Protocol-relative URLs point elsewhere; relative paths already
+		// resolve under the prefix.
+		return
+	}
+	u.Path = prefix + u.Path
+	u.RawPath = ""
+	header.Set("Location", u.String())
+}
+
+// rewriteCookies scopes cookies set by the upstream to prefix and drops
+// their Domain, which names the peer rather than TailTunnel.
+func rewriteCookies(header http.Header, prefix string) {
+	values := header.Values("Set-Cookie")
+	if len(values) == 0 {
+		return
+	}
+
+	header.Del("Set-Cookie")
+	for _, v := range values {
+		c, err := http.ParseSetCookie(v)
+		if err != nil {
+			continue
+		}
+		c.Domain = ""
+		if c.Path == "" || c.Path == "/" {
+			c.Path = prefix + "/"
+		} else if strings.HasPrefix(c.Path, "/") {
+			c.Path = prefix + c.Path
+		}
+		header.Add("Set-Cookie", c.String())
+	}
+}
@@ -0,0 +1,186 @@
+package recording
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rajsinghtech/tailtunnel/internal/identity"
+)
+
+// Handler serves recordings to the users who made them, and every
+// recording to callers isAuditor approves.
+type Handler struct {
+	store     *Store
+	isAuditor func(*identity.Identity) bool
+}
+
+func NewHandler(store *Store, isAuditor func(*identity.Identity) bool) *Handler {
+	return &Handler{store: store, isAuditor: isAuditor}
+}
+
+func (h *Handler) List(w http.ResponseWriter, r *http.Request) {
+	recordings, err := h.store.List()
+	if err != nil {
+		log.Printf("Failed to list recordings: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !h.isAuditor(identity.FromContext(r.Context())) {
+		caller := identity.OwnerName(r.Context())
+		own := []Info{}
+		for _, info := range recordings {
+			if caller != "" && info.Identity == caller {
+				own = append(own, info)
+			}
+		}
+		recordings = own
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(recordings)
+}
+
+// open opens the recording named in the path if the caller may read it.
+// Recordings of other users are reported as not found.
+func (h *Handler) open(r *http.Request) (*os.File, error) {
+	id := chi.URLParam(r, "id")
+	if !h.isAuditor(identity.FromContext(r.Context())) {
+		info, err := h.store.Stat(id)
+		if err != nil {
+			return nil, err
+		}
+		if caller := identity.OwnerName(r.Context()); caller == "" || info.Identity != caller {
+			return nil, ErrNotFound
+		}
+	}
+	return h.store.Open(id)
+}
+
+func (h *Handler) Download(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	f, err := h.open(r)
+	if err != nil {
+		writeOpenError(w, id, err)
+		return
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-asciicast")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", id+fileExt))
+	http.ServeContent(w, r, id+fileExt, stat.ModTime(), f)
+}
+
+// Stream replays a recording as server-sent events, sleeping between events
+// to reproduce the original timing. The "speed" query parameter scales
+// playback and "idleLimit" caps pauses (in seconds, 0 disables the cap).
+func (h *Handler) Stream(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	f, err := h.open(r)
+	if err != nil {
+		writeOpenError(w, id, err)
+		return
+	}
+	defer f.Close()
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	speed := queryFloat(r, "speed", 1)
+	if speed <= 0 {
+		speed = 1
+	}
+	idleLimit := queryFloat(r, "idleLimit", 2)
+
+	br := bufio.NewReader(f)
+	header, err := readHeader(br)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	headerJSON, _ := json.Marshal(header)
+	writeSSE(w, "header", headerJSON)
+	flusher.Flush()
+
+	var last float64
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			var event []json.RawMessage
+			var at float64
+			if json.Unmarshal(line, &event) != nil || len(event) != 3 || json.Unmarshal(event[0], &at) != nil {
+				continue
+			}
+
+			delay := at - last
+			if idleLimit > 0 && delay > idleLimit {
+				delay = idleLimit
+			}
+			last = at
+
+			if delay > 0 {
+				select {
+				case <-time.After(time.Duration(delay / speed * float64(time.Second))):
+				case <-r.Context().Done():
+					return
+				}
+			}
+
+			writeSSE(w, "event", bytes.TrimRight(line, "\r\n"))
+			flusher.Flush()
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("Failed to read recording %s: %v", id, err)
+			}
+			break
+		}
+	}
+
+	writeSSE(w, "end", []byte("{}"))
+	flusher.Flush()
+}
+
+func writeSSE(w io.Writer, event string, data []byte) {
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+}
+
+func writeOpenError(w http.ResponseWriter, id string, err error) {
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "recording not found", http.StatusNotFound)
+		return
+	}
+	log.Printf("Failed to open recording %s: %v", id, err)
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+func queryFloat(r *http.Request, key string, def float64) float64 {
+	v, err := strconv.ParseFloat(r.URL.Query().Get(key), 64)
+	if err != nil {
+		return def
+	}
+	return v
+}
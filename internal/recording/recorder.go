@@ -0,0 +1,140 @@
+package recording
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Event codes defined by the asciicast v2 format.
+const (
+	EventOutput = "o"
+	EventInput  = "i"
+	EventResize = "r"
+)
+
+// Metadata identifies who recorded a session and where. It is stored in the
+// asciicast header under the "tailtunnel" key, which players ignore.
+type Metadata struct {
+	Machine  string `json:"machine"`
+	User     string `json:"user"`
+	Identity string `json:"identity,omitempty"`
+}
+
+// Header is the first line of an asciicast v2 file.
+type Header struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+	Metadata  Metadata          `json:"tailtunnel"`
+}
+
+// Recorder appends events to an asciicast v2 file. A nil *Recorder is valid
+// and records nothing, so callers don't need to check whether recording is
+// enabled.
+type Recorder struct {
+	mu      sync.Mutex
+	w       io.WriteCloser
+	start   time.Time
+	pending map[string][]byte
+}
+
+func newRecorder(w io.WriteCloser, header Header, start time.Time) (*Recorder, error) {
+	line, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(append(line, '\n')); err != nil {
+		return nil, err
+	}
+
+	return &Recorder{
+		w:       w,
+		start:   start,
+		pending: make(map[string][]byte),
+	}, nil
+}
+
+// Output records bytes written by the remote side.
+func (r *Recorder) Output(p []byte) {
+	r.write(EventOutput, p)
+}
+
+// Input records bytes typed by the browser user.
+func (r *Recorder) Input(p []byte) {
+	r.write(EventInput, p)
+}
+
+// Resize records a terminal size change.
+func (r *Recorder) Resize(cols, rows int) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.writeEvent(EventResize, fmt.Sprintf("%dx%d", cols, rows))
+}
+
+func (r *Recorder) write(code string, p []byte) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Reads can split multi-byte characters; hold back an incomplete
+	// trailing rune until the next chunk so the JSON string stays valid.
+	buf := append(r.pending[code], p...)
+	n := completeUTF8(buf)
+	r.pending[code] = append([]byte(nil), buf[n:]...)
+	if n == 0 {
+		return
+	}
+	r.writeEvent(code, string(buf[:n]))
+}
+
+func (r *Recorder) writeEvent(code, data string) {
+	elapsed := time.Since(r.start).Seconds()
+	line, err := json.Marshal([]any{elapsed, code, data})
+	if err != nil {
+		return
+	}
+	r.w.Write(append(line, '\n'))
+}
+
+// Close writes any held-back bytes and closes the underlying file.
+func (r *Recorder) Close() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for code, rest := range r.pending {
+		if len(rest) > 0 {
+			r.writeEvent(code, string(rest))
+		}
+	}
+	return r.w.Close()
+}
+
+// completeUTF8 returns the length of the longest prefix of p that doesn't end
+// in the middle of a multi-byte UTF-8 sequence.
+func completeUTF8(p []byte) int {
+	for i := 1; i <= utf8.UTFMax && i <= len(p); i++ {
+		b := p[len(p)-i]
+		if utf8.RuneStart(b) {
+			if !utf8.FullRune(p[len(p)-i:]) {
+				return len(p) - i
+			}
+			return len(p)
+		}
+	}
+	return len(p)
+}
@@ -0,0 +1,227 @@
+package recording
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const fileExt = ".cast"
+
+var validID = regexp.MustCompile(`^[0-9TZ]+-[0-9a-f]{8}$`)
+
+// ErrNotFound is returned for unknown or malformed recording IDs.
+var ErrNotFound = errors.New("recording not found")
+
+// Info describes a stored recording.
+type Info struct {
+	ID        string    `json:"id"`
+	Machine   string    `json:"machine"`
+	User      string    `json:"user"`
+	Identity  string    `json:"identity,omitempty"`
+	StartedAt time.Time `json:"startedAt"`
+	Width     int       `json:"width"`
+	Height    int       `json:"height"`
+	Size      int64     `json:"size"`
+}
+
+// pruneInterval is how often Create looks for expired recordings.
+const pruneInterval = time.Hour
+
+// Store keeps asciicast recordings as files in a single directory, deleting
+// those last written to before the retention period.
+type Store struct {
+	dir       string
+	retention time.Duration
+
+	mu     sync.Mutex
+	pruned time.Time
+}
+
+// NewStore returns a store in dir. A retention of zero keeps recordings
+// forever.
+func NewStore(dir string, retention time.Duration) *Store {
+	s := &Store{dir: dir, retention: retention}
+	s.prune(time.Now())
+	return s
+}
+
+// Create starts a new recording and returns its ID along with the recorder.
+func (s *Store) Create(meta Metadata, width, height int) (string, *Recorder, error) {
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return "", nil, fmt.Errorf("failed to create recordings directory: %w", err)
+	}
+
+	now := time.Now()
+	s.prune(now)
+
+	id, err := newID(now)
+	if err != nil {
+		return "", nil, err
+	}
+
+	f, err := os.OpenFile(s.path(id), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create recording: %w", err)
+	}
+
+	header := Header{
+		Version:   2,
+		Width:     width,
+		Height:    height,
+		Timestamp: now.Unix(),
+		Title:     fmt.Sprintf("%s@%s", meta.User, meta.Machine),
+		Env:       map[string]string{"TERM": "xterm-256color"},
+		Metadata:  meta,
+	}
+
+	rec, err := newRecorder(f, header, now)
+	if err != nil {
+		f.Close()
+		os.Remove(s.path(id))
+		return "", nil, fmt.Errorf("failed to write recording header: %w", err)
+	}
+
+	return id, rec, nil
+}
+
+// List returns all recordings, newest first.
+func (s *Store) List() ([]Info, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []Info{}, nil
+		}
+		return nil, err
+	}
+
+	infos := []Info{}
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), fileExt)
+		if !ok || !validID.MatchString(id) {
+			continue
+		}
+		info, err := s.Stat(id)
+		if err != nil {
+			continue
+		}
+		infos = append(infos, *info)
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].StartedAt.After(infos[j].StartedAt)
+	})
+
+	return infos, nil
+}
+
+// Stat reads the header of a single recording.
+func (s *Store) Stat(id string) (*Info, error) {
+	f, err := s.Open(id)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	header, err := readHeader(bufio.NewReader(f))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Info{
+		ID:        id,
+		Machine:   header.Metadata.Machine,
+		User:      header.Metadata.User,
+		Identity:  header.Metadata.Identity,
+		StartedAt: time.Unix(header.Timestamp, 0),
+		Width:     header.Width,
+		Height:    header.Height,
+		Size:      fi.Size(),
+	}, nil
+}
+
+// Open opens a recording for reading.
+func (s *Store) Open(id string) (*os.File, error) {
+	if !validID.MatchString(id) {
+		return nil, ErrNotFound
+	}
+	f, err := os.Open(s.path(id))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+// prune deletes recordings last written to before the retention period,
+// at most once every pruneInterval.
+func (s *Store) prune(now time.Time) {
+	if s.retention <= 0 {
+		return
+	}
+	s.mu.Lock()
+	if now.Sub(s.pruned) < pruneInterval {
+		s.mu.Unlock()
+		return
+	}
+	s.pruned = now
+	s.mu.Unlock()
+
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return
+	}
+	cutoff := now.Add(-s.retention)
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), fileExt)
+		if !ok || !validID.MatchString(id) {
+			continue
+		}
+		fi, err := entry.Info()
+		if err != nil || !fi.ModTime().Before(cutoff) {
+			continue
+		}
+		if err := os.Remove(s.path(id)); err == nil {
+			log.Printf("Removed expired recording %s", id)
+		}
+	}
+}
+
+func (s *Store) path(id string) string {
+	return filepath.Join(s.dir, id+fileExt)
+}
+
+func readHeader(r *bufio.Reader) (*Header, error) {
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return nil, fmt.Errorf("failed to read header: %w", err)
+	}
+	var header Header
+	if err := json.Unmarshal(line, &header); err != nil {
+		return nil, fmt.Errorf("invalid header: %w", err)
+	}
+	return &header, nil
+}
+
+func newID(t time.Time) (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return t.UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(b), nil
+}
@@ -0,0 +1,170 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SetupError is returned when an SSH connection can't be established. Stage
+// names the step that failed, e.g. "dial" or "auth".
+type SetupError struct {
+	Stage   string
+	Message string
+	Err     error
+}
+
+func (e *SetupError) Error() string {
+	return e.Message + ": " + e.Err.Error()
+}
+
+func (e *SetupError) Unwrap() error {
+	return e.Err
+}
+
+// Credentials supplies keys to offer servers that don't use Tailscale SSH,
+// such as plain OpenSSH.
+type Credentials interface {
+	Signers(ctx context.Context, machine, user string) ([]ssh.Signer, error)
+}
+
+// CertAuthority mints a short-lived certificate that lets the caller in ctx
+// log in to machine as user, for hosts that trust it via TrustedUserCAKeys.
+type CertAuthority interface {
+	Sign(ctx context.Context, machine, user string) (ssh.Signer, error)
+}
+
+// Prompter relays interactive parts of the SSH handshake to a person:
+// pre-authentication banners, such as the one Tailscale SSH sends with a
+// login URL in check mode, and keyboard-interactive or password challenges.
+type Prompter interface {
+	Banner(message string) error
+	Challenge(name, instruction string, questions []string, echos []bool) ([]string, error)
+}
+
+// handshakeTimeout bounds the SSH handshake when nobody can answer
+// prompts. With a Prompter it may take as long as someone needs to finish
+// a check-mode login.
+const (
+	handshakeTimeout            = 30 * time.Second
+	interactiveHandshakeTimeout = 5 * time.Minute
+)
+
+// errAuthAborted is wrapped by errors that end the handshake during
+// authentication, such as a prompt the user canceled.
+var errAuthAborted = errors.New("authentication aborted")
+
+var urlPattern = regexp.MustCompile(`https?://[^\s"'<>]+`)
+
+// bannerURLs returns the links in an SSH banner.
+func bannerURLs(message string) []string {
+	return urlPattern.FindAllString(message, -1)
+}
+
+// dialClient connects to machine over the tailnet and completes the SSH
+// handshake as user, verifying the host key. If prompter is nil, a
+// Tailscale SSH check-mode banner fails the handshake instead of waiting
+// for a login nobody will see. Closing the returned client closes the
+// underlying connection.
+func (h *SSHHandler) dialClient(ctx context.Context, machine, user string, prompter Prompter) (*ssh.Client, error) {
+	callerCtx := ctx
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	hostKeyCallback, err := h.HostKeys.Callback(ctx, machine)
+	if err != nil {
+		return nil, &SetupError{Stage: stageHostKey, Message: "Failed to verify host key", Err: err}
+	}
+
+	// Tailscale SSH accepts the "none" method, which is always tried
+	// first; stored keys and a CA certificate are only offered to servers
+	// that ask for a public key.
+	auth := []ssh.AuthMethod{
+		ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+			return h.signers(callerCtx, machine, user), nil
+		}),
+	}
+
+	netConn, err := h.DialFunc(ctx, machine)
+	if err != nil {
+		return nil, &SetupError{Stage: stageDial, Message: "Failed to dial machine", Err: err}
+	}
+
+	config := &ssh.ClientConfig{
+		User:            user,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         10 * time.Second,
+	}
+
+	// The handshake doesn't watch ctx, so bound it with a deadline on the
+	// connection itself.
+	timeout := handshakeTimeout
+	if prompter != nil {
+		timeout = interactiveHandshakeTimeout
+		config.BannerCallback = prompter.Banner
+		config.Auth = append(config.Auth,
+			ssh.KeyboardInteractive(prompter.Challenge),
+			ssh.PasswordCallback(func() (string, error) {
+				answers, err := prompter.Challenge("", "", []string{"Password: "}, []bool{false})
+				if err != nil || len(answers) != 1 {
+					return "", err
+				}
+				return answers[0], nil
+			}),
+		)
+	} else {
+		config.BannerCallback = func(message string) error {
+			if strings.Contains(message, "Tailscale SSH") && len(bannerURLs(message)) > 0 {
+				return fmt.Errorf("%w: %s requires an interactive check, authenticate at %s", errAuthAborted, machine, bannerURLs(message)[0])
+			}
+			return nil
+		}
+	}
+	netConn.SetDeadline(time.Now().Add(timeout))
+
+	sshConn, chans, reqs, err := ssh.NewClientConn(netConn, machine+":22", config)
+	if err != nil {
+		netConn.Close()
+		var hostKeyErr *HostKeyError
+		if errors.As(err, &hostKeyErr) {
+			return nil, &SetupError{Stage: stageHostKey, Message: "WARNING: REMOTE HOST IDENTIFICATION FAILED. Refusing to connect", Err: hostKeyErr}
+		}
+		if errors.Is(err, errAuthAborted) || strings.Contains(err.Error(), "unable to authenticate") {
+			return nil, &SetupError{Stage: stageAuth, Message: "SSH authentication failed", Err: err}
+		}
+		return nil, &SetupError{Stage: stageDial, Message: "Failed to create SSH connection", Err: err}
+	}
+	netConn.SetDeadline(time.Time{})
+
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
+
+// signers returns the keys to offer machine: a freshly minted certificate
+// if a CA is configured, then any stored keys bound to it. Failures are
+// logged rather than returned so the remaining auth methods still run.
+func (h *SSHHandler) signers(ctx context.Context, machine, user string) []ssh.Signer {
+	var signers []ssh.Signer
+	if h.CA != nil {
+		signer, err := h.CA.Sign(ctx, machine, user)
+		if err != nil {
+			log.Printf("Failed to issue certificate for %s@%s: %v", user, machine, err)
+		} else {
+			signers = append(signers, signer)
+		}
+	}
+	if h.Credentials != nil {
+		stored, err := h.Credentials.Signers(ctx, machine, user)
+		if err != nil {
+			log.Printf("Failed to load credentials for %s@%s: %v", user, machine, err)
+		}
+		signers = append(signers, stored...)
+	}
+	return signers
+}
@@ -0,0 +1,355 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rajsinghtech/tailtunnel/internal/audit"
+	"github.com/rajsinghtech/tailtunnel/internal/identity"
+	"github.com/rajsinghtech/tailtunnel/internal/policy"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	defaultExecTimeout = time.Minute
+	maxExecTimeout     = time.Hour
+
+	// maxExecOutput caps how much of each output stream is kept in an
+	// ExecResult. Streaming clients still see everything.
+	maxExecOutput = 1 << 20
+)
+
+// ExecRequest is a non-interactive command to run on a machine.
+type ExecRequest struct {
+	Command string            `json:"command"`
+	User    string            `json:"user,omitempty"`
+	Stdin   string            `json:"stdin,omitempty"`
+	Env     map[string]string `json:"env,omitempty"`
+
+	// Timeout is a Go duration such as "30s". The command is killed when it
+	// expires. Defaults to one minute.
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// ExecResult describes how a command ended. Exactly one of ExitCode,
+// ExitMissing or Error is set once the command has run.
+type ExecResult struct {
+	Machine     string `json:"machine"`
+	User        string `json:"user"`
+	Command     string `json:"command"`
+	Stdout      string `json:"stdout,omitempty"`
+	Stderr      string `json:"stderr,omitempty"`
+	Truncated   bool   `json:"truncated,omitempty"`
+	ExitCode    *int   `json:"exitCode,omitempty"`
+	Signal      string `json:"signal,omitempty"`
+	ExitMissing bool   `json:"exitMissing,omitempty"`
+	Error       string `json:"error,omitempty"`
+	TimedOut    bool   `json:"timedOut,omitempty"`
+	DurationMs  int64  `json:"durationMs"`
+}
+
+// Validate fills in defaults and reports whether req can be run.
+func (req *ExecRequest) Validate() error {
+	if strings.TrimSpace(req.Command) == "" {
+		return errors.New("command is required")
+	}
+	if req.User == "" {
+		req.User = "root"
+	}
+	for k := range req.Env {
+		if k == "" || strings.ContainsAny(k, "=\x00") {
+			return fmt.Errorf("invalid environment variable name %q", k)
+		}
+	}
+	if _, err := req.timeout(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (req *ExecRequest) timeout() (time.Duration, error) {
+	if req.Timeout == "" {
+		return defaultExecTimeout, nil
+	}
+	d, err := time.ParseDuration(req.Timeout)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid timeout %q", req.Timeout)
+	}
+	if d > maxExecTimeout {
+		return 0, fmt.Errorf("timeout %q exceeds the maximum of %s", req.Timeout, maxExecTimeout)
+	}
+	return d, nil
+}
+
+// Exec runs req on machine without a PTY and waits for it to finish. The
+// caller in ctx must pass the Authorizer. If onOutput is non-nil it receives
+// each chunk of "stdout" and "stderr" as it arrives; calls are serialized.
+//
+// A non-nil error means the command never ran: the request was invalid, the
+// caller was denied, or the connection could not be set up (*SetupError).
+// Failures of the command itself are reported in the result.
+func (h *SSHHandler) Exec(ctx context.Context, machine string, req ExecRequest, onOutput func(stream string, p []byte)) (*ExecResult, error) {
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+	timeout, _ := req.timeout()
+
+	if err := h.authorize(ctx, machine, req.User); err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	result, err := h.exec(ctx, machine, req, timeout, onOutput)
+
+	ev := audit.NewEvent(ctx, audit.ActionSSHExec)
+	ev.Machine = machine
+	ev.RemoteUser = req.User
+	ev.Details = map[string]any{"command": req.Command}
+	if err != nil {
+		ev.Outcome = audit.OutcomeFailure
+		ev.Reason = err.Error()
+		h.Audit.Log(ev)
+		return nil, err
+	}
+
+	result.DurationMs = time.Since(start).Milliseconds()
+	ev.Outcome = audit.OutcomeSuccess
+	ev.Details["durationMs"] = result.DurationMs
+	if result.ExitCode != nil {
+		ev.Details["exitCode"] = *result.ExitCode
+	}
+	if result.Signal != "" {
+		ev.Details["signal"] = result.Signal
+	}
+	if result.TimedOut {
+		ev.Details["timedOut"] = true
+	}
+	if result.Error != "" {
+		ev.Reason = result.Error
+	}
+	h.Audit.Log(ev)
+
+	return result, nil
+}
+
+func (h *SSHHandler) exec(ctx context.Context, machine string, req ExecRequest, timeout time.Duration, onOutput func(string, []byte)) (*ExecResult, error) {
+	client, release, err := h.connect(ctx, machine, req.User, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, &SetupError{Stage: stageSetup, Message: "Failed to create SSH session", Err: err}
+	}
+	defer session.Close()
+
+	for k, v := range req.Env {
+		if err := session.Setenv(k, v); err != nil {
+			return nil, &SetupError{Stage: stageSetup, Message: fmt.Sprintf("Server rejected environment variable %s", k), Err: err}
+		}
+	}
+
+	var mu sync.Mutex
+	stdout := &execOutput{mu: &mu, stream: "stdout", onOutput: onOutput}
+	stderr := &execOutput{mu: &mu, stream: "stderr", onOutput: onOutput}
+	session.Stdout = stdout
+	session.Stderr = stderr
+	if req.Stdin != "" {
+		session.Stdin = strings.NewReader(req.Stdin)
+	}
+
+	if err := session.Start(req.Command); err != nil {
+		return nil, &SetupError{Stage: stageSetup, Message: "Failed to start command", Err: err}
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Wait()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	result := &ExecResult{Machine: machine, User: req.User, Command: req.Command}
+
+	var waitErr error
+	select {
+	case waitErr = <-done:
+	case <-timer.C:
+		result.TimedOut = true
+		session.Signal(ssh.SIGKILL)
+		session.Close()
+		waitErr = <-done
+	case <-ctx.Done():
+		session.Signal(ssh.SIGKILL)
+		session.Close()
+		waitErr = <-done
+	}
+
+	status := newExitStatus(waitErr)
+	result.ExitCode = status.ExitCode
+	result.Signal = status.Signal
+	result.ExitMissing = status.ExitMissing
+	result.Error = status.Error
+	switch {
+	case result.TimedOut:
+		result.Error = fmt.Sprintf("command timed out after %s", timeout)
+	case ctx.Err() != nil:
+		result.Error = fmt.Sprintf("command canceled: %v", ctx.Err())
+	}
+
+	mu.Lock()
+	result.Stdout = stdout.buf.String()
+	result.Stderr = stderr.buf.String()
+	result.Truncated = stdout.truncated || stderr.truncated
+	mu.Unlock()
+
+	return result, nil
+}
+
+// execOutput collects one output stream of a command, keeping at most
+// maxExecOutput bytes, and forwards every chunk to onOutput.
+type execOutput struct {
+	mu        *sync.Mutex
+	stream    string
+	onOutput  func(string, []byte)
+	buf       bytes.Buffer
+	truncated bool
+}
+
+func (o *execOutput) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.onOutput != nil {
+		o.onOutput(o.stream, p)
+	}
+
+	keep := p
+	if room := maxExecOutput - o.buf.Len(); len(keep) > room {
+		keep = keep[:max(room, 0)]
+		o.truncated = true
+	}
+	o.buf.Write(keep)
+	return len(p), nil
+}
+
+// HandleExec runs the JSON-encoded ExecRequest in the request body on
+// machine. By default it responds with the ExecResult once the command
+// finishes. Clients that accept text/event-stream (or pass "stream=true")
+// instead get "stdout" and "stderr" events as output arrives, followed by a
+// "result" event without the collected output, or an "error" event if the
+// command couldn't be started.
+//
+// The body must be sent as application/json from TailTunnel's own origin,
+// which a cross-site form or no-cors fetch can't do.
+func (h *SSHHandler) HandleExec(w http.ResponseWriter, r *http.Request, machine string) {
+	if !identity.SameOrigin(r) {
+		http.Error(w, "cross-site requests are not allowed", http.StatusForbidden)
+		return
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	var req ExecRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := req.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if r.URL.Query().Get("stream") == "true" || strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		h.streamExec(w, r, machine, req)
+		return
+	}
+
+	result, err := h.Exec(r.Context(), machine, req, nil)
+	if err != nil {
+		log.Printf("Exec on %s@%s failed: %v", req.User, machine, err)
+		http.Error(w, err.Error(), execErrorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func (h *SSHHandler) streamExec(w http.ResponseWriter, r *http.Request, machine string, req ExecRequest) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher.Flush()
+
+	// Exec serializes calls to the output callback, and only writes the
+	// final event after the command has finished, so w is never written
+	// concurrently.
+	result, err := h.Exec(r.Context(), machine, req, func(stream string, p []byte) {
+		data, _ := json.Marshal(string(p))
+		writeSSE(w, stream, data)
+		flusher.Flush()
+	})
+	if err != nil {
+		log.Printf("Exec on %s@%s failed: %v", req.User, machine, err)
+		data, _ := json.Marshal(execError(err))
+		writeSSE(w, msgError, data)
+		flusher.Flush()
+		return
+	}
+
+	result.Stdout, result.Stderr = "", ""
+	data, _ := json.Marshal(result)
+	writeSSE(w, "result", data)
+	flusher.Flush()
+}
+
+// execError describes why a command couldn't be started, using the same
+// stages as the terminal websocket.
+func execError(err error) serverMessage {
+	var setupErr *SetupError
+	if errors.As(err, &setupErr) {
+		return serverMessage{Type: msgError, Stage: setupErr.Stage, Message: err.Error()}
+	}
+	var denied *policy.DeniedError
+	if errors.As(err, &denied) {
+		return serverMessage{Type: msgError, Stage: stagePolicy, Message: "Access denied: " + denied.Reason}
+	}
+	return serverMessage{Type: msgError, Stage: stageSetup, Message: err.Error()}
+}
+
+func execErrorStatus(err error) int {
+	var setupErr *SetupError
+	if errors.As(err, &setupErr) {
+		return http.StatusBadGateway
+	}
+	var denied *policy.DeniedError
+	if errors.As(err, &denied) {
+		return http.StatusForbidden
+	}
+	return http.StatusBadRequest
+}
+
+func writeSSE(w io.Writer, event string, data []byte) {
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+}
@@ -0,0 +1,41 @@
+package ssh
+
+import (
+	"context"
+	"net"
+)
+
+// DialForward authorizes the caller in ctx to log in to machine as user and
+// opens a direct-tcpip channel from machine to addr, like "ssh -L". addr is
+// resolved on machine, so it may be localhost or a host on a network only
+// the machine can reach. Closing the returned connection also releases the
+// SSH connection underneath it.
+func (h *SSHHandler) DialForward(ctx context.Context, machine, user, addr string) (net.Conn, error) {
+	if err := h.authorize(ctx, machine, user); err != nil {
+		return nil, err
+	}
+
+	client, release, err := h.connect(ctx, machine, user, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := client.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		release()
+		return nil, &SetupError{Stage: stageSetup, Message: "Failed to open forward to " + addr, Err: err}
+	}
+
+	return &forwardConn{Conn: conn, release: release}, nil
+}
+
+type forwardConn struct {
+	net.Conn
+	release func()
+}
+
+func (c *forwardConn) Close() error {
+	err := c.Conn.Close()
+	c.release()
+	return err
+}
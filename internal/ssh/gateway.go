@@ -0,0 +1,582 @@
+package ssh
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rajsinghtech/tailtunnel/internal/audit"
+	"github.com/rajsinghtech/tailtunnel/internal/identity"
+	"github.com/rajsinghtech/tailtunnel/internal/recording"
+	"golang.org/x/crypto/ssh"
+)
+
+// errLoginFailed is returned for auth attempts after the reason a login
+// can't succeed has already been shown to the client.
+var errLoginFailed = errors.New("login failed")
+
+// Gateway is an SSH server that lets native ssh clients reach tailnet
+// machines through TailTunnel. Clients log in as "user+machine"; the caller
+// is identified by their tailnet address, authorized and audited the same
+// way as browser sessions, and their channels are relayed to the target.
+type Gateway struct {
+	handler  *SSHHandler
+	identify func(ctx context.Context, remoteAddr string) (*identity.Identity, error)
+	hostKey  ssh.Signer
+}
+
+// NewGateway returns a gateway that connects through h. Its host key is
+// read from hostKeyPath, and generated there on first use.
+func NewGateway(h *SSHHandler, hostKeyPath string, identify func(ctx context.Context, remoteAddr string) (*identity.Identity, error)) (*Gateway, error) {
+	hostKey, err := loadHostKey(hostKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	return &Gateway{handler: h, identify: identify, hostKey: hostKey}, nil
+}
+
+func loadHostKey(path string) (ssh.Signer, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		block, err := ssh.MarshalPrivateKey(priv, "tailtunnel")
+		if err != nil {
+			return nil, err
+		}
+		data = pem.EncodeToMemory(block)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return nil, fmt.Errorf("failed to create host key directory: %w", err)
+		}
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			return nil, fmt.Errorf("failed to write host key: %w", err)
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(data)
+}
+
+// Serve accepts connections on ln until it is closed.
+func (g *Gateway) Serve(ln net.Listener) error {
+	log.Printf("SSH gateway listening on %s (%s)", ln.Addr(), ssh.FingerprintSHA256(g.hostKey.PublicKey()))
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go g.handle(conn)
+	}
+}
+
+// gatewayConn is one client connection and the upstream connection it is
+// relayed to.
+type gatewayConn struct {
+	gateway *Gateway
+	caller  *identity.Identity
+	ctx     context.Context
+	preAuth ssh.ServerPreAuthConn
+
+	failed  bool
+	client  *ssh.Client
+	release func()
+	machine string
+	user    string
+}
+
+func (g *Gateway) handle(conn net.Conn) {
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+	caller, err := g.identify(ctx, conn.RemoteAddr().String())
+	cancel()
+	if err != nil {
+		log.Printf("SSH gateway: refusing unidentified connection from %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	c := &gatewayConn{gateway: g, caller: caller, ctx: identity.NewContext(context.Background(), caller)}
+	config := &ssh.ServerConfig{
+		ServerVersion: "SSH-2.0-TailTunnel",
+		NoClientAuth:  true,
+		NoClientAuthCallback: func(meta ssh.ConnMetadata) (*ssh.Permissions, error) {
+			return c.login(meta.User(), nil)
+		},
+		KeyboardInteractiveCallback: func(meta ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			return c.login(meta.User(), &gatewayPrompter{conn: c.preAuth, challenge: challenge})
+		},
+		PreAuthConnCallback: func(conn ssh.ServerPreAuthConn) {
+			c.preAuth = conn
+		},
+	}
+	config.AddHostKey(g.hostKey)
+
+	// The upstream handshake may wait on an interactive login, so allow
+	// the client's handshake at least as long.
+	conn.SetDeadline(time.Now().Add(interactiveHandshakeTimeout + handshakeTimeout))
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		if c.release != nil {
+			c.release()
+		}
+		log.Printf("SSH gateway: handshake with %s failed: %v", caller.LoginName, err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	defer c.release()
+
+	log.Printf("SSH gateway: %s connected to %s@%s", caller.LoginName, c.user, c.machine)
+
+	go ssh.DiscardRequests(reqs)
+	go func() {
+		c.client.Wait()
+		sconn.Close()
+	}()
+
+	for newCh := range chans {
+		switch newCh.ChannelType() {
+		case "session":
+			go c.session(newCh)
+		case "direct-tcpip":
+			go c.directTCPIP(newCh)
+		default:
+			newCh.Reject(ssh.UnknownChannelType, "unsupported channel type")
+		}
+	}
+}
+
+// login authorizes the caller for the "user+machine" target and connects
+// to it. Without a prompter, a login that needs interaction fails so the
+// client retries with keyboard-interactive, which relays prompts.
+func (c *gatewayConn) login(target string, prompter Prompter) (*ssh.Permissions, error) {
+	if c.failed {
+		return nil, errLoginFailed
+	}
+
+	user, machine, ok := strings.Cut(target, "+")
+	if !ok || user == "" || machine == "" {
+		return nil, c.fail("Log in as user+machine, for example: ssh root+web-1@tailtunnel")
+	}
+
+	h := c.gateway.handler
+	if err := h.authorize(c.ctx, machine, user); err != nil {
+		return nil, c.fail("Access denied: " + denialReason(err))
+	}
+
+	client, release, err := h.connect(c.ctx, machine, user, prompter)
+	if err != nil {
+		var setupErr *SetupError
+		if prompter == nil && errors.As(err, &setupErr) && setupErr.Stage == stageAuth {
+			return nil, err
+		}
+		ev := audit.NewEvent(c.ctx, audit.ActionSSHStart)
+		ev.Outcome = audit.OutcomeFailure
+		ev.Machine = machine
+		ev.RemoteUser = user
+		ev.Reason = err.Error()
+		ev.Details = map[string]any{"via": "gateway"}
+		h.Audit.Log(ev)
+		return nil, c.fail(err.Error())
+	}
+
+	c.client = client
+	c.release = release
+	c.machine = machine
+	c.user = user
+	return &ssh.Permissions{}, nil
+}
+
+// fail shows message to the client and fails every later auth attempt.
+func (c *gatewayConn) fail(message string) error {
+	c.failed = true
+	return &ssh.BannerError{Err: errLoginFailed, Message: message + "\n"}
+}
+
+// gatewayPrompter relays the target's banners and challenges to the
+// client during the keyboard-interactive exchange.
+type gatewayPrompter struct {
+	conn      ssh.ServerPreAuthConn
+	challenge ssh.KeyboardInteractiveChallenge
+}
+
+func (p *gatewayPrompter) Banner(message string) error {
+	if p.conn == nil {
+		return nil
+	}
+	return p.conn.SendAuthBanner(message)
+}
+
+func (p *gatewayPrompter) Challenge(name, instruction string, questions []string, echos []bool) ([]string, error) {
+	answers, err := p.challenge(name, instruction, questions, echos)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errAuthAborted, err)
+	}
+	return answers, nil
+}
+
+// openUpstream opens a channel like newCh on the target and accepts newCh
+// once it has, passing on the target's refusal otherwise.
+func (c *gatewayConn) openUpstream(newCh ssh.NewChannel) (down, up ssh.Channel, downReqs, upReqs <-chan *ssh.Request, err error) {
+	up, upReqs, err = c.client.OpenChannel(newCh.ChannelType(), newCh.ExtraData())
+	if err != nil {
+		var openErr *ssh.OpenChannelError
+		if errors.As(err, &openErr) {
+			newCh.Reject(openErr.Reason, openErr.Message)
+		} else {
+			newCh.Reject(ssh.ConnectionFailed, err.Error())
+		}
+		return nil, nil, nil, nil, err
+	}
+
+	down, downReqs, err = newCh.Accept()
+	if err != nil {
+		up.Close()
+		return nil, nil, nil, nil, err
+	}
+	return down, up, downReqs, upReqs, nil
+}
+
+// channelHooks observe a spliced channel. Every field is optional.
+type channelHooks struct {
+	// request is called for each client request before it is forwarded,
+	// and replied is called with the target's answer.
+	request func(req *ssh.Request)
+	replied func(req *ssh.Request, ok bool)
+
+	// upstreamRequest is called for each request from the target, such
+	// as "exit-status".
+	upstreamRequest func(req *ssh.Request)
+
+	input  func(p []byte)
+	output func(p []byte)
+}
+
+// splice relays data and requests between a client channel and the
+// matching target channel until the target closes it or the client goes
+// away.
+func splice(down ssh.Channel, downReqs <-chan *ssh.Request, up ssh.Channel, upReqs <-chan *ssh.Request, hooks channelHooks) {
+	go func() {
+		for req := range downReqs {
+			if hooks.request != nil {
+				hooks.request(req)
+			}
+			ok, err := up.SendRequest(req.Type, req.WantReply, req.Payload)
+			if err != nil {
+				ok = false
+			}
+			if hooks.replied != nil {
+				hooks.replied(req, ok)
+			}
+			if req.WantReply {
+				req.Reply(ok, nil)
+			}
+		}
+		up.Close()
+	}()
+
+	go func() {
+		io.Copy(&tapWriter{w: up, tap: hooks.input}, down)
+		up.CloseWrite()
+	}()
+
+	var outputs sync.WaitGroup
+	outputs.Add(2)
+	go func() {
+		defer outputs.Done()
+		io.Copy(&tapWriter{w: down, tap: hooks.output}, up)
+	}()
+	go func() {
+		defer outputs.Done()
+		io.Copy(&tapWriter{w: down.Stderr(), tap: hooks.output}, up.Stderr())
+	}()
+
+	for req := range upReqs {
+		if hooks.upstreamRequest != nil {
+			hooks.upstreamRequest(req)
+		}
+		ok, _ := down.SendRequest(req.Type, req.WantReply, req.Payload)
+		if req.WantReply {
+			req.Reply(ok, nil)
+		}
+	}
+
+	outputs.Wait()
+	down.CloseWrite()
+	down.Close()
+}
+
+type tapWriter struct {
+	w   io.Writer
+	tap func(p []byte)
+}
+
+func (t *tapWriter) Write(p []byte) (int, error) {
+	if t.tap != nil {
+		t.tap(p)
+	}
+	return t.w.Write(p)
+}
+
+// gatewaySession tracks what a session channel is used for so it can be
+// recorded and audited like a browser session or an exec call.
+type gatewaySession struct {
+	conn  *gatewayConn
+	id    string
+	start time.Time
+
+	rec      atomic.Pointer[recording.Recorder]
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+
+	mu         sync.Mutex
+	pty        bool
+	cols, rows int
+	kind       string // "shell", "exec" or "subsystem"
+	command    string
+	recordID   string
+	exitCode   *int
+	signal     string
+}
+
+func (c *gatewayConn) session(newCh ssh.NewChannel) {
+	down, up, downReqs, upReqs, err := c.openUpstream(newCh)
+	if err != nil {
+		log.Printf("SSH gateway: failed to open session on %s: %v", c.machine, err)
+		return
+	}
+
+	c.gateway.handler.gatewaySessions.Add(1)
+	defer c.gateway.handler.gatewaySessions.Add(-1)
+
+	s := &gatewaySession{conn: c, id: newSessionID(), start: time.Now()}
+	splice(down, downReqs, up, upReqs, channelHooks{
+		request:         s.request,
+		replied:         s.replied,
+		upstreamRequest: s.upstreamRequest,
+		input: func(p []byte) {
+			s.bytesIn.Add(int64(len(p)))
+			s.rec.Load().Input(p)
+		},
+		output: func(p []byte) {
+			s.bytesOut.Add(int64(len(p)))
+			s.rec.Load().Output(p)
+		},
+	})
+	s.end()
+}
+
+func (s *gatewaySession) request(req *ssh.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch req.Type {
+	case "pty-req":
+		var msg struct {
+			Term          string
+			Columns, Rows uint32
+			Width, Height uint32
+			Modes         string
+		}
+		if ssh.Unmarshal(req.Payload, &msg) == nil {
+			s.pty = true
+			s.cols, s.rows = clampSize(msg.Columns, defaultCols), clampSize(msg.Rows, defaultRows)
+		}
+	case "window-change":
+		var msg struct {
+			Columns, Rows uint32
+			Width, Height uint32
+		}
+		if ssh.Unmarshal(req.Payload, &msg) == nil {
+			s.rec.Load().Resize(clampSize(msg.Columns, defaultCols), clampSize(msg.Rows, defaultRows))
+		}
+	case "shell", "exec":
+		if req.Type == "exec" {
+			var msg struct{ Command string }
+			if ssh.Unmarshal(req.Payload, &msg) != nil {
+				return
+			}
+			s.command = msg.Command
+		}
+		s.kind = req.Type
+		// Interactive sessions are recorded like browser terminals. The
+		// recorder must exist before the target starts sending output.
+		h := s.conn.gateway.handler
+		if s.pty && h.Recordings != nil {
+			id, rec, err := h.Recordings.Create(recording.Metadata{
+				Machine:  s.conn.machine,
+				User:     s.conn.user,
+				Identity: s.conn.caller.OwnerName(),
+			}, s.cols, s.rows)
+			if err != nil {
+				log.Printf("SSH gateway: failed to start recording: %v", err)
+				return
+			}
+			s.rec.Store(rec)
+			s.recordID = id
+		}
+	case "subsystem":
+		var msg struct{ Name string }
+		if ssh.Unmarshal(req.Payload, &msg) == nil {
+			s.kind = req.Type
+			s.command = msg.Name
+		}
+	}
+}
+
+func (s *gatewaySession) replied(req *ssh.Request, ok bool) {
+	if req.Type != "shell" && req.Type != "exec" && req.Type != "subsystem" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !ok {
+		s.rec.Swap(nil).Close()
+		s.kind = ""
+		return
+	}
+	if s.kind == "shell" {
+		ev := s.auditEvent(audit.ActionSSHStart)
+		ev.Details["cols"] = s.cols
+		ev.Details["rows"] = s.rows
+		if s.recordID != "" {
+			ev.Details["recording"] = s.recordID
+		}
+		s.conn.gateway.handler.Audit.Log(ev)
+	}
+}
+
+func (s *gatewaySession) upstreamRequest(req *ssh.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch req.Type {
+	case "exit-status":
+		var msg struct{ Status uint32 }
+		if ssh.Unmarshal(req.Payload, &msg) == nil {
+			code := int(msg.Status)
+			s.exitCode = &code
+		}
+	case "exit-signal":
+		var msg struct {
+			Signal     string
+			CoreDumped bool
+			Error      string
+			Lang       string
+		}
+		if ssh.Unmarshal(req.Payload, &msg) == nil {
+			s.signal = msg.Signal
+		}
+	}
+}
+
+// end records how the session finished.
+func (s *gatewaySession) end() {
+	s.rec.Swap(nil).Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.kind == "" {
+		return
+	}
+
+	action := audit.ActionSSHExec
+	if s.kind == "shell" {
+		action = audit.ActionSSHEnd
+	}
+	ev := s.auditEvent(action)
+	ev.Details["durationMs"] = time.Since(s.start).Milliseconds()
+	ev.Details["bytesIn"] = s.bytesIn.Load()
+	ev.Details["bytesOut"] = s.bytesOut.Load()
+	switch s.kind {
+	case "exec":
+		ev.Details["command"] = s.command
+	case "subsystem":
+		ev.Details["subsystem"] = s.command
+	}
+	switch {
+	case s.exitCode != nil:
+		ev.Details["exitStatus"] = *s.exitCode
+	case s.signal != "":
+		ev.Details["signal"] = s.signal
+	default:
+		ev.Details["exitMissing"] = true
+	}
+
+	s.conn.gateway.handler.Audit.Log(ev)
+}
+
+func (s *gatewaySession) auditEvent(action string) audit.Event {
+	ev := audit.NewEvent(s.conn.ctx, action)
+	ev.Outcome = audit.OutcomeSuccess
+	ev.Machine = s.conn.machine
+	ev.RemoteUser = s.conn.user
+	ev.SessionID = s.id
+	ev.Details = map[string]any{"via": "gateway"}
+	return ev
+}
+
+// directTCPIP relays a port forward ("ssh -L") through the target.
+func (c *gatewayConn) directTCPIP(newCh ssh.NewChannel) {
+	var msg struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	if err := ssh.Unmarshal(newCh.ExtraData(), &msg); err != nil {
+		newCh.Reject(ssh.ConnectionFailed, "malformed direct-tcpip request")
+		return
+	}
+	addr := net.JoinHostPort(msg.Host, strconv.Itoa(int(msg.Port)))
+
+	ev := audit.NewEvent(c.ctx, audit.ActionTCPTunnel)
+	ev.Machine = c.machine
+	ev.RemoteUser = c.user
+	ev.Details = map[string]any{"port": msg.Port, "forward": addr, "via": "gateway"}
+
+	down, up, downReqs, upReqs, err := c.openUpstream(newCh)
+	if err != nil {
+		log.Printf("SSH gateway: failed to forward to %s via %s: %v", addr, c.machine, err)
+		ev.Outcome = audit.OutcomeFailure
+		ev.Reason = err.Error()
+		c.gateway.handler.Audit.Log(ev)
+		return
+	}
+
+	start := time.Now()
+	var bytesIn, bytesOut atomic.Int64
+	splice(down, downReqs, up, upReqs, channelHooks{
+		input:  func(p []byte) { bytesIn.Add(int64(len(p))) },
+		output: func(p []byte) { bytesOut.Add(int64(len(p))) },
+	})
+
+	ev.Outcome = audit.OutcomeSuccess
+	ev.Details["bytesIn"] = bytesIn.Load()
+	ev.Details["bytesOut"] = bytesOut.Load()
+	ev.Details["durationMs"] = time.Since(start).Milliseconds()
+	c.gateway.handler.Audit.Log(ev)
+}
+
+// clampSize bounds a terminal dimension from the client like clampDim.
+func clampSize(n uint32, def int) int {
+	switch {
+	case n == 0:
+		return def
+	case n > maxDim:
+		return maxDim
+	}
+	return int(n)
+}
@@ -0,0 +1,134 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// HostKeyVerifier checks the host key presented by a machine against the SSH
+// host keys Tailscale publishes for that peer. Peers that publish no keys
+// (e.g. plain OpenSSH servers) fall back to trust-on-first-use against a
+// known_hosts file.
+type HostKeyVerifier struct {
+	LookupKeys     func(ctx context.Context, machine string) ([]string, error)
+	KnownHostsPath string
+
+	mu sync.Mutex
+}
+
+// HostKeyError is returned when the presented host key is not trusted.
+type HostKeyError struct {
+	Machine     string
+	Fingerprint string
+	Reason      string
+}
+
+func (e *HostKeyError) Error() string {
+	return fmt.Sprintf("host key verification failed for %s (%s): %s", e.Machine, e.Fingerprint, e.Reason)
+}
+
+// Callback returns a host key callback for machine. It must be created before
+// dialing so that the netmap lookup isn't done during the SSH handshake.
+func (v *HostKeyVerifier) Callback(ctx context.Context, machine string) (ssh.HostKeyCallback, error) {
+	published, err := v.LookupKeys(ctx, machine)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up host keys: %w", err)
+	}
+
+	if len(published) == 0 {
+		return v.trustOnFirstUse(machine), nil
+	}
+
+	// If none of the published keys parse, keys stays empty and every
+	// presented key is rejected.
+	var keys []ssh.PublicKey
+	for _, k := range published {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(k))
+		if err != nil {
+			log.Printf("Ignoring unparseable host key for %s: %v", machine, err)
+			continue
+		}
+		keys = append(keys, key)
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		for _, k := range keys {
+			if bytes.Equal(k.Marshal(), key.Marshal()) {
+				return nil
+			}
+		}
+		return &HostKeyError{
+			Machine:     machine,
+			Fingerprint: ssh.FingerprintSHA256(key),
+			Reason:      "key does not match any host key Tailscale publishes for this peer",
+		}
+	}, nil
+}
+
+func (v *HostKeyVerifier) trustOnFirstUse(machine string) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		v.mu.Lock()
+		defer v.mu.Unlock()
+
+		if err := ensureFile(v.KnownHostsPath); err != nil {
+			return fmt.Errorf("failed to create known_hosts: %w", err)
+		}
+
+		check, err := knownhosts.New(v.KnownHostsPath)
+		if err != nil {
+			return fmt.Errorf("failed to read known_hosts: %w", err)
+		}
+
+		err = check(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) {
+			return err
+		}
+
+		if len(keyErr.Want) > 0 {
+			return &HostKeyError{
+				Machine:     machine,
+				Fingerprint: ssh.FingerprintSHA256(key),
+				Reason:      "key differs from the one recorded in " + v.KnownHostsPath,
+			}
+		}
+
+		log.Printf("Trusting new host key for %s on first use: %s", machine, ssh.FingerprintSHA256(key))
+		return appendKnownHost(v.KnownHostsPath, hostname, key)
+	}
+}
+
+func ensureFile(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0600)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func appendKnownHost(path, hostname string, key ssh.PublicKey) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open known_hosts: %w", err)
+	}
+	defer f.Close()
+
+	line := knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key)
+	if _, err := fmt.Fprintln(f, line); err != nil {
+		return fmt.Errorf("failed to write known_hosts: %w", err)
+	}
+	return nil
+}
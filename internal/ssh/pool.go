@@ -0,0 +1,318 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rajsinghtech/tailtunnel/internal/identity"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	keepaliveInterval = 30 * time.Second
+	keepaliveTimeout  = 15 * time.Second
+
+	// maxPooledSessions keeps a shared connection under OpenSSH's default
+	// MaxSessions of 10; further sessions get a connection of their own.
+	maxPooledSessions = 10
+)
+
+// Pool shares SSH connections between sessions, like OpenSSH's
+// ControlMaster. Connections are keyed by machine, remote user and tailnet
+// caller, so one person's connection is never used by another. A
+// connection nobody has used for the idle timeout is closed, as is one
+// that stops answering keepalives.
+type Pool struct {
+	idleTimeout time.Duration
+
+	mu    sync.Mutex
+	conns map[poolKey][]*pooledConn
+}
+
+type poolKey struct {
+	machine  string
+	user     string
+	identity string
+}
+
+// PooledConn describes a shared connection.
+type PooledConn struct {
+	Machine       string    `json:"machine"`
+	User          string    `json:"user"`
+	Identity      string    `json:"identity"`
+	CreatedAt     time.Time `json:"createdAt"`
+	LastUsed      time.Time `json:"lastUsed"`
+	Sessions      int       `json:"sessions"`
+	LastKeepalive time.Time `json:"lastKeepalive,omitzero"`
+	RTTMs         int64     `json:"rttMs,omitempty"`
+}
+
+type pooledConn struct {
+	key     poolKey
+	client  *ssh.Client
+	created time.Time
+
+	// ready is closed once the connection is dialed; err is set if that
+	// failed.
+	ready chan struct{}
+	err   error
+
+	// Guarded by Pool.mu.
+	refs          int
+	lastUsed      time.Time
+	lastKeepalive time.Time
+	rtt           time.Duration
+	idle          *time.Timer
+	closed        bool
+}
+
+// NewPool returns a pool that closes connections after idleTimeout without
+// sessions.
+func NewPool(idleTimeout time.Duration) *Pool {
+	return &Pool{
+		idleTimeout: idleTimeout,
+		conns:       make(map[poolKey][]*pooledConn),
+	}
+}
+
+// get returns a connection for key, dialing one with dial if none has room
+// for another session. The returned release function must be called once
+// the caller's session is done; it is safe to call more than once.
+func (p *Pool) get(ctx context.Context, key poolKey, dial func() (*ssh.Client, error)) (*ssh.Client, func(), error) {
+	for {
+		p.mu.Lock()
+		pc := p.findLocked(key)
+		if pc == nil {
+			pc = &pooledConn{key: key, created: time.Now(), ready: make(chan struct{}), refs: 1}
+			p.conns[key] = append(p.conns[key], pc)
+			p.mu.Unlock()
+			return p.dial(pc, dial)
+		}
+		pc.refs++
+		p.mu.Unlock()
+
+		select {
+		case <-pc.ready:
+		case <-ctx.Done():
+			p.release(pc)
+			return nil, nil, ctx.Err()
+		}
+		if pc.err != nil {
+			// The dial we waited for failed, perhaps because it couldn't
+			// prompt for a login and this caller can; try our own.
+			continue
+		}
+		return pc.client, p.releaser(pc), nil
+	}
+}
+
+// findLocked returns a live or still dialing connection for key with room
+// for another session.
+func (p *Pool) findLocked(key poolKey) *pooledConn {
+	for _, pc := range p.conns[key] {
+		if !pc.closed && pc.refs < maxPooledSessions {
+			return pc
+		}
+	}
+	return nil
+}
+
+func (p *Pool) dial(pc *pooledConn, dial func() (*ssh.Client, error)) (*ssh.Client, func(), error) {
+	client, err := dial()
+
+	p.mu.Lock()
+	if err != nil {
+		pc.err = err
+		pc.closed = true
+		p.removeLocked(pc)
+		p.mu.Unlock()
+		close(pc.ready)
+		return nil, nil, err
+	}
+	pc.client = client
+	pc.lastUsed = time.Now()
+	p.mu.Unlock()
+	close(pc.ready)
+
+	log.Printf("Opened pooled SSH connection to %s@%s for %s", pc.key.user, pc.key.machine, pc.key.identity)
+
+	go func() {
+		client.Wait()
+		p.close(pc, "connection lost")
+	}()
+	go p.keepalive(pc)
+
+	return client, p.releaser(pc), nil
+}
+
+func (p *Pool) releaser(pc *pooledConn) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() { p.release(pc) })
+	}
+}
+
+func (p *Pool) release(pc *pooledConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pc.refs--
+	pc.lastUsed = time.Now()
+	if pc.refs > 0 || pc.closed || pc.client == nil {
+		return
+	}
+	if pc.idle != nil {
+		pc.idle.Stop()
+	}
+	pc.idle = time.AfterFunc(p.idleTimeout, func() {
+		p.mu.Lock()
+		idle := pc.refs == 0
+		p.mu.Unlock()
+		if idle {
+			p.close(pc, "idle")
+		}
+	})
+}
+
+// keepalive checks pc is still responsive until it is closed. A failure
+// reply still proves the server is there; only errors and timeouts count.
+func (p *Pool) keepalive(pc *pooledConn) {
+	ticker := time.NewTicker(keepaliveInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		p.mu.Lock()
+		closed := pc.closed
+		p.mu.Unlock()
+		if closed {
+			return
+		}
+
+		start := time.Now()
+		done := make(chan error, 1)
+		go func() {
+			_, _, err := pc.client.SendRequest("keepalive@openssh.com", true, nil)
+			done <- err
+		}()
+
+		var err error
+		select {
+		case err = <-done:
+		case <-time.After(keepaliveTimeout):
+			err = errors.New("keepalive timed out")
+		}
+		if err != nil {
+			log.Printf("Pooled SSH connection to %s@%s failed health check: %v", pc.key.user, pc.key.machine, err)
+			p.close(pc, "keepalive failed")
+			return
+		}
+
+		p.mu.Lock()
+		pc.lastKeepalive = time.Now()
+		pc.rtt = time.Since(start)
+		p.mu.Unlock()
+	}
+}
+
+// close removes pc from the pool and closes its connection, ending any
+// sessions still using it.
+func (p *Pool) close(pc *pooledConn, reason string) {
+	p.mu.Lock()
+	if pc.closed {
+		p.mu.Unlock()
+		return
+	}
+	pc.closed = true
+	if pc.idle != nil {
+		pc.idle.Stop()
+	}
+	p.removeLocked(pc)
+	p.mu.Unlock()
+
+	pc.client.Close()
+	log.Printf("Closed pooled SSH connection to %s@%s for %s (%s)", pc.key.user, pc.key.machine, pc.key.identity, reason)
+}
+
+func (p *Pool) removeLocked(pc *pooledConn) {
+	conns := p.conns[pc.key]
+	for i, c := range conns {
+		if c == pc {
+			conns = append(conns[:i], conns[i+1:]...)
+			break
+		}
+	}
+	if len(conns) == 0 {
+		delete(p.conns, pc.key)
+	} else {
+		p.conns[pc.key] = conns
+	}
+}
+
+// List returns the open connections, most recently used first.
+func (p *Pool) List() []PooledConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	conns := []PooledConn{}
+	for _, pcs := range p.conns {
+		for _, pc := range pcs {
+			if pc.client == nil {
+				continue
+			}
+			conns = append(conns, PooledConn{
+				Machine:       pc.key.machine,
+				User:          pc.key.user,
+				Identity:      pc.key.identity,
+				CreatedAt:     pc.created,
+				LastUsed:      pc.lastUsed,
+				Sessions:      pc.refs,
+				LastKeepalive: pc.lastKeepalive,
+				RTTMs:         pc.rtt.Milliseconds(),
+			})
+		}
+	}
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].LastUsed.After(conns[j].LastUsed)
+	})
+	return conns
+}
+
+// connect returns an SSH connection to machine as user for the caller in
+// ctx, shared with the caller's other sessions when h has a Pool. The
+// release function must be called once the caller is done with it.
+func (h *SSHHandler) connect(ctx context.Context, machine, user string, prompter Prompter) (*ssh.Client, func(), error) {
+	dial := func() (*ssh.Client, error) {
+		return h.dialClient(ctx, machine, user, prompter)
+	}
+
+	if h.Pool == nil {
+		client, err := dial()
+		if err != nil {
+			return nil, nil, err
+		}
+		return client, func() { client.Close() }, nil
+	}
+
+	key := poolKey{machine: machine, user: user, identity: identity.OwnerName(ctx)}
+	return h.Pool.get(ctx, key, dial)
+}
+
+// Connections returns the pooled connections belonging to the caller in
+// ctx.
+func (h *SSHHandler) Connections(ctx context.Context) []PooledConn {
+	conns := []PooledConn{}
+	if h.Pool == nil {
+		return conns
+	}
+	owner := identity.OwnerName(ctx)
+	for _, c := range h.Pool.List() {
+		if c.Identity == owner {
+			conns = append(conns, c)
+		}
+	}
+	return conns
+}
@@ -0,0 +1,66 @@
+package ssh
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsPrompter relays the interactive parts of the handshake to the browser.
+// It reads the websocket directly, which is safe because the session read
+// loop only starts once the handshake is done.
+type wsPrompter struct {
+	conn *websocket.Conn
+	next int
+}
+
+func (p *wsPrompter) Banner(message string) error {
+	writeControl(p.conn, serverMessage{Type: msgBanner, Message: message, URLs: bannerURLs(message)})
+	return nil
+}
+
+func (p *wsPrompter) Challenge(name, instruction string, questions []string, echos []bool) ([]string, error) {
+	// Servers send empty challenges to show instructions, and Tailscale
+	// SSH uses them in check mode; nothing needs answering.
+	if len(questions) == 0 {
+		if text := strings.TrimSpace(strings.Join([]string{name, instruction}, "\n")); text != "" {
+			p.Banner(text)
+		}
+		return []string{}, nil
+	}
+
+	p.next++
+	msg := serverMessage{
+		Type:        msgPrompt,
+		PromptID:    p.next,
+		Name:        name,
+		Instruction: instruction,
+		URLs:        bannerURLs(instruction),
+	}
+	for i, q := range questions {
+		msg.Prompts = append(msg.Prompts, promptField{Text: q, Echo: i < len(echos) && echos[i]})
+	}
+	writeControl(p.conn, msg)
+
+	for {
+		messageType, data, err := p.conn.ReadMessage()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errAuthAborted, err)
+		}
+		if messageType != websocket.TextMessage {
+			continue
+		}
+		answer, ok := parseControlMessage(data)
+		if !ok || answer.Type != msgAnswer || answer.PromptID != p.next {
+			continue
+		}
+		if answer.Cancel {
+			return nil, fmt.Errorf("%w: login canceled", errAuthAborted)
+		}
+		if len(answer.Answers) != len(questions) {
+			return nil, fmt.Errorf("%w: expected %d answers, got %d", errAuthAborted, len(questions), len(answer.Answers))
+		}
+		return answer.Answers, nil
+	}
+}
@@ -0,0 +1,152 @@
+package ssh
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strconv"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Control messages are JSON text frames sent alongside raw terminal input.
+// Clients that only send raw bytes keep working: any frame that doesn't
+// decode as a known control message is written to the remote stdin.
+const (
+	msgResize = "resize"
+	msgSignal = "signal"
+	msgAnswer = "answer"
+)
+
+// allowedSignals are the signals a client may deliver to the remote process.
+var allowedSignals = map[string]ssh.Signal{
+	"INT":  ssh.SIGINT,
+	"TERM": ssh.SIGTERM,
+	"KILL": ssh.SIGKILL,
+	"HUP":  ssh.SIGHUP,
+	"QUIT": ssh.SIGQUIT,
+}
+
+// Messages sent by the server as JSON text frames. Terminal output is always
+// sent as binary frames.
+const (
+	msgSession = "session"
+	msgClosed  = "closed"
+	msgRole    = "role"
+	msgError   = "error"
+	msgBanner  = "banner"
+	msgPrompt  = "prompt"
+)
+
+// Stages at which a session can fail to start, reported in error messages.
+const (
+	stageSession = "session"
+	stagePolicy  = "policy"
+	stageHostKey = "hostkey"
+	stageDial    = "dial"
+	stageAuth    = "auth"
+	stageSetup   = "setup"
+)
+
+const (
+	defaultCols = 80
+	defaultRows = 24
+	maxDim      = 1000
+)
+
+type controlMessage struct {
+	Type   string `json:"type"`
+	Cols   int    `json:"cols,omitempty"`
+	Rows   int    `json:"rows,omitempty"`
+	Signal string `json:"signal,omitempty"`
+
+	// Answers to a prompt, or Cancel to give up logging in.
+	PromptID int      `json:"promptId,omitempty"`
+	Answers  []string `json:"answers,omitempty"`
+	Cancel   bool     `json:"cancel,omitempty"`
+}
+
+type serverMessage struct {
+	Type    string `json:"type"`
+	ID      string `json:"id,omitempty"`
+	Role    string `json:"role,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+	Stage   string `json:"stage,omitempty"`
+	Message string `json:"message,omitempty"`
+	*exitStatus
+
+	// Banners carry any links found in Message; Tailscale SSH check mode
+	// sends the login URL this way.
+	URLs []string `json:"urls,omitempty"`
+
+	// Authentication challenges. Each prompt is answered in order.
+	PromptID    int           `json:"promptId,omitempty"`
+	Name        string        `json:"name,omitempty"`
+	Instruction string        `json:"instruction,omitempty"`
+	Prompts     []promptField `json:"prompts,omitempty"`
+}
+
+type promptField struct {
+	Text string `json:"text"`
+	Echo bool   `json:"echo"`
+}
+
+// exitStatus describes how the remote shell ended, as reported by
+// ssh.Session.Wait.
+type exitStatus struct {
+	ExitCode    *int   `json:"exitCode,omitempty"`
+	Signal      string `json:"signal,omitempty"`
+	ExitMissing bool   `json:"exitMissing,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+func newExitStatus(waitErr error) *exitStatus {
+	var exitErr *ssh.ExitError
+	var missingErr *ssh.ExitMissingError
+	switch {
+	case waitErr == nil:
+		code := 0
+		return &exitStatus{ExitCode: &code}
+	case errors.As(waitErr, &exitErr):
+		code := exitErr.ExitStatus()
+		return &exitStatus{ExitCode: &code, Signal: exitErr.Signal()}
+	case errors.As(waitErr, &missingErr):
+		return &exitStatus{ExitMissing: true}
+	default:
+		return &exitStatus{Error: waitErr.Error()}
+	}
+}
+
+func parseControlMessage(p []byte) (*controlMessage, bool) {
+	if len(p) == 0 || p[0] != '{' {
+		return nil, false
+	}
+
+	var msg controlMessage
+	if err := json.Unmarshal(p, &msg); err != nil {
+		return nil, false
+	}
+
+	switch msg.Type {
+	case msgResize, msgSignal, msgAnswer:
+		return &msg, true
+	}
+	return nil, false
+}
+
+// termSize reads the initial terminal size from the connect request,
+// falling back to 80x24 for clients that don't send one.
+func termSize(q url.Values) (cols, rows int) {
+	return clampDim(q.Get("cols"), defaultCols), clampDim(q.Get("rows"), defaultRows)
+}
+
+func clampDim(s string, def int) int {
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		return def
+	}
+	if n > maxDim {
+		return maxDim
+	}
+	return n
+}
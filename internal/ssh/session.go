@@ -1 +1,610 @@
 package ssh
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rajsinghtech/tailtunnel/internal/audit"
+	"github.com/rajsinghtech/tailtunnel/internal/recording"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	defaultScrollback = 256 * 1024
+	writeTimeout      = 10 * time.Second
+
+	// participantQueue is how many messages may wait to be written to a
+	// participant before it is dropped for not keeping up.
+	participantQueue = 128
+
+	// reasonExited marks sessions that ended because the remote shell did,
+	// as opposed to being closed by TailTunnel.
+	reasonExited = "remote shell exited"
+)
+
+// Roles a participant can have in a session. The owner started the session;
+// viewers only receive output, drivers may also type if the owner allows it.
+const (
+	RoleOwner  = "owner"
+	RoleViewer = "viewer"
+	RoleDriver = "driver"
+)
+
+var (
+	ErrSessionClosed   = errors.New("session has ended")
+	ErrNotShared       = errors.New("the session owner has not shared this session with you")
+	ErrDriveNotAllowed = errors.New("the session owner has not allowed co-drivers")
+)
+
+// Sharing is who the owner lets join a session. Sessions are private until
+// the owner allows viewers.
+type Sharing struct {
+	AllowView bool `json:"allowView"`
+	// AllowDrive lets participants type as well; it implies AllowView.
+	AllowDrive bool `json:"allowDrive"`
+	// Users, when set, limits joining to these login names, or node names
+	// for tagged nodes.
+	Users []string `json:"users,omitempty"`
+}
+
+func (sh Sharing) allows(identity string) bool {
+	return sh.AllowView && (len(sh.Users) == 0 || slices.Contains(sh.Users, identity))
+}
+
+// Participant is a websocket client attached to a session. Messages to it
+// are queued and written by its own goroutine, so a slow viewer can't hold
+// up the session or the other participants.
+type Participant struct {
+	ID       string    `json:"id"`
+	Identity string    `json:"identity,omitempty"`
+	Role     string    `json:"role"`
+	JoinedAt time.Time `json:"joinedAt"`
+
+	conn    *websocket.Conn
+	out     chan outMessage
+	done    chan struct{}
+	stopped bool
+}
+
+type outMessage struct {
+	typ  int
+	data []byte
+}
+
+func newParticipant(conn *websocket.Conn, identity, role string) *Participant {
+	p := &Participant{
+		ID:       newSessionID(),
+		Identity: identity,
+		Role:     role,
+		JoinedAt: time.Now(),
+		conn:     conn,
+		out:      make(chan outMessage, participantQueue),
+		done:     make(chan struct{}),
+	}
+	go p.writeLoop()
+	return p
+}
+
+// send queues data for p without blocking. It reports false if p's queue is
+// full or p has been stopped.
+func (p *Participant) send(typ int, data []byte) bool {
+	select {
+	case <-p.done:
+		return false
+	default:
+	}
+	select {
+	case p.out <- outMessage{typ: typ, data: data}:
+		return true
+	default:
+		return false
+	}
+}
+
+// sendWait queues data for p, waiting for room until p is stopped.
+func (p *Participant) sendWait(typ int, data []byte) {
+	select {
+	case p.out <- outMessage{typ: typ, data: data}:
+	case <-p.done:
+	}
+}
+
+func (p *Participant) sendControl(msg serverMessage) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	p.send(websocket.TextMessage, data)
+}
+
+// stop closes p's websocket once the messages already queued are written.
+// It is called with the session's lock held.
+func (p *Participant) stop() {
+	if !p.stopped {
+		p.stopped = true
+		close(p.done)
+	}
+}
+
+// writeLoop writes p's queue to its websocket. A failed write closes the
+// websocket, which ends its read loop and so detaches p.
+func (p *Participant) writeLoop() {
+	defer p.conn.Close()
+
+	for {
+		select {
+		case msg := <-p.out:
+			if !p.write(msg) {
+				return
+			}
+		case <-p.done:
+			for {
+				select {
+				case msg := <-p.out:
+					if !p.write(msg) {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (p *Participant) write(msg outMessage) bool {
+	p.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if err := p.conn.WriteMessage(msg.typ, msg.data); err != nil {
+		log.Printf("WebSocket write error: %v", err)
+		return false
+	}
+	return true
+}
+
+// Session is an interactive SSH session that outlives the websocket that
+// started it. While the owner is detached the remote shell keeps running and
+// its output is kept in a bounded scrollback buffer, which is replayed to
+// every client that attaches. Output fans out to the owner and all viewers.
+type Session struct {
+	ID        string    `json:"id"`
+	Machine   string    `json:"machine"`
+	User      string    `json:"user"`
+	Identity  string    `json:"identity,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+
+	login    string
+	node     string
+	registry *Registry
+	audit    *audit.Logger
+	release  func()
+	session  *ssh.Session
+	stdin    io.WriteCloser
+	rec      *recording.Recorder
+
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+
+	mu          sync.Mutex
+	scrollback  *ringBuffer
+	owner       *Participant
+	viewers     map[string]*Participant
+	sharing     Sharing
+	detachTimer *time.Timer
+	closed      bool
+}
+
+// pump copies remote output to the scrollback and every participant until
+// r returns an error.
+func (s *Session) pump(r io.Reader, name string) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			s.broadcast(buf[:n])
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("SSH %s read error: %v", name, err)
+			}
+			return
+		}
+	}
+}
+
+// broadcast records p and queues it for every participant. The owner's
+// pace throttles the remote shell, as it would over plain SSH, but viewers
+// whose queue is full are disconnected rather than waited for.
+func (s *Session) broadcast(p []byte) {
+	// p is reused by the caller, and the writes happen after it returns.
+	data := append([]byte(nil), p...)
+
+	s.mu.Lock()
+	s.scrollback.Write(data)
+	s.rec.Output(data)
+	s.bytesOut.Add(int64(len(data)))
+
+	for _, v := range s.viewers {
+		if !v.send(websocket.BinaryMessage, data) {
+			log.Printf("Dropping %s from SSH session %s: not keeping up with output", v.Identity, s.ID)
+			s.detachLocked(v)
+			v.conn.Close()
+		}
+	}
+	owner := s.owner
+	s.mu.Unlock()
+
+	if owner != nil {
+		owner.sendWait(websocket.BinaryMessage, data)
+	}
+}
+
+func (s *Session) participantsLocked() []*Participant {
+	all := make([]*Participant, 0, len(s.viewers)+1)
+	if s.owner != nil {
+		all = append(all, s.owner)
+	}
+	for _, v := range s.viewers {
+		all = append(all, v)
+	}
+	return all
+}
+
+// attach makes conn the session's owner connection, replacing any previous
+// one, and replays the scrollback so the terminal can catch up.
+func (s *Session) attach(conn *websocket.Conn) (*Participant, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, ErrSessionClosed
+	}
+
+	if s.detachTimer != nil {
+		s.detachTimer.Stop()
+		s.detachTimer = nil
+	}
+
+	if s.owner != nil {
+		s.owner.sendControl(serverMessage{Type: msgClosed, Reason: "session attached from another client"})
+		s.owner.stop()
+	}
+
+	s.owner = newParticipant(conn, s.Identity, RoleOwner)
+	s.welcomeLocked(s.owner)
+	return s.owner, nil
+}
+
+// join adds conn as an additional participant. Viewers only receive output;
+// drivers may also send input if the owner allows co-drivers.
+func (s *Session) join(conn *websocket.Conn, identity string, drive bool) (*Participant, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, ErrSessionClosed
+	}
+
+	if !s.sharing.allows(identity) {
+		return nil, ErrNotShared
+	}
+	role := RoleViewer
+	if drive {
+		if !s.sharing.AllowDrive {
+			return nil, ErrDriveNotAllowed
+		}
+		role = RoleDriver
+	}
+
+	p := newParticipant(conn, identity, role)
+	s.viewers[p.ID] = p
+	s.welcomeLocked(p)
+
+	log.Printf("%s joined SSH session %s as %s", identity, s.ID, role)
+	return p, nil
+}
+
+func (s *Session) welcomeLocked(p *Participant) {
+	p.sendControl(serverMessage{Type: msgSession, ID: s.ID, Role: p.Role})
+	if backlog := s.scrollback.Bytes(); len(backlog) > 0 {
+		p.send(websocket.BinaryMessage, backlog)
+	}
+}
+
+// canWrite reports whether p may send input to the remote shell.
+func (s *Session) canWrite(p *Participant) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return p.Role == RoleOwner || p.Role == RoleDriver
+}
+
+// detach removes p from the session. When the owner detaches, the grace
+// period after which an unattached session is torn down starts.
+func (s *Session) detach(p *Participant) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.detachLocked(p)
+}
+
+func (s *Session) detachLocked(p *Participant) {
+	if s.closed {
+		return
+	}
+
+	if _, ok := s.viewers[p.ID]; ok {
+		delete(s.viewers, p.ID)
+		p.stop()
+		return
+	}
+
+	if s.owner != p {
+		return
+	}
+	s.owner.stop()
+	s.owner = nil
+
+	grace := s.registry.grace
+	log.Printf("SSH session %s detached, keeping it alive for %s", s.ID, grace)
+	var timer *time.Timer
+	timer = time.AfterFunc(grace, func() {
+		// A reattach may have won the race for the lock after the timer
+		// fired, in which case Stop came too late to prevent this call.
+		s.mu.Lock()
+		if s.owner != nil || s.detachTimer != timer {
+			s.mu.Unlock()
+			return
+		}
+		log.Printf("SSH session %s was not reattached, closing", s.ID)
+		s.closeLocked("not reattached within "+grace.String(), nil)
+	})
+	s.detachTimer = timer
+}
+
+// Participants lists everyone currently attached, owner first.
+func (s *Session) Participants() []Participant {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var list []Participant
+	for _, p := range s.participantsLocked() {
+		list = append(list, *p)
+	}
+	return list
+}
+
+// Revoke disconnects a viewer or driver. The owner can't be revoked.
+func (s *Session) Revoke(participantID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.viewers[participantID]
+	if !ok {
+		return false
+	}
+	p.sendControl(serverMessage{Type: msgClosed, Reason: "access revoked by the session owner"})
+	delete(s.viewers, p.ID)
+	p.stop()
+
+	log.Printf("Revoked %s from SSH session %s", p.Identity, s.ID)
+	return true
+}
+
+// SetSharing changes who may join the session. Participants it no longer
+// allows are disconnected, and drivers are demoted to viewers if co-drivers
+// are no longer allowed.
+func (s *Session) SetSharing(sh Sharing) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sh.AllowDrive {
+		sh.AllowView = true
+	}
+	s.sharing = sh
+
+	for _, p := range s.viewers {
+		if !sh.allows(p.Identity) {
+			p.sendControl(serverMessage{Type: msgClosed, Reason: "the session owner stopped sharing"})
+			delete(s.viewers, p.ID)
+			p.stop()
+			log.Printf("Removed %s from SSH session %s after sharing changed", p.Identity, s.ID)
+			continue
+		}
+		if p.Role == RoleDriver && !sh.AllowDrive {
+			p.Role = RoleViewer
+			p.sendControl(serverMessage{Type: msgRole, Role: RoleViewer})
+		}
+	}
+}
+
+// Sharing returns who may join the session.
+func (s *Session) Sharing() Sharing {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sharing
+}
+
+// Close tears down the SSH session and disconnects every participant.
+func (s *Session) Close() {
+	s.closeWithReason("closed", nil)
+}
+
+// closeWithReason closes the session and records its end in the audit log.
+// waitErr is the result of ssh.Session.Wait if the remote shell exited.
+func (s *Session) closeWithReason(reason string, waitErr error) {
+	s.mu.Lock()
+	s.closeLocked(reason, waitErr)
+}
+
+// closeLocked is closeWithReason for callers holding s.mu, which it
+// releases.
+func (s *Session) closeLocked(reason string, waitErr error) {
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	if s.detachTimer != nil {
+		s.detachTimer.Stop()
+	}
+
+	var status *exitStatus
+	if reason == reasonExited {
+		status = newExitStatus(waitErr)
+	}
+	for _, p := range s.participantsLocked() {
+		p.sendControl(serverMessage{Type: msgClosed, Reason: reason, exitStatus: status})
+		p.stop()
+	}
+	s.owner = nil
+	s.viewers = nil
+	s.mu.Unlock()
+
+	s.registry.remove(s.ID)
+	s.session.Close()
+	s.release()
+	s.rec.Close()
+
+	ev := s.auditEvent(audit.ActionSSHEnd)
+	ev.Reason = reason
+	ev.Details = map[string]any{
+		"durationMs": time.Since(s.CreatedAt).Milliseconds(),
+		"bytesIn":    s.bytesIn.Load(),
+		"bytesOut":   s.bytesOut.Load(),
+	}
+	if status != nil {
+		switch {
+		case status.ExitCode != nil:
+			ev.Details["exitStatus"] = *status.ExitCode
+			if status.Signal != "" {
+				ev.Details["signal"] = status.Signal
+			}
+		case status.ExitMissing:
+			ev.Details["exitMissing"] = true
+		default:
+			ev.Outcome = audit.OutcomeFailure
+			ev.Details["error"] = status.Error
+		}
+	}
+	s.audit.Log(ev)
+}
+
+func (s *Session) auditEvent(action string) audit.Event {
+	return audit.Event{
+		Time:       time.Now(),
+		Action:     action,
+		User:       s.login,
+		Node:       s.node,
+		Machine:    s.Machine,
+		RemoteUser: s.User,
+		SessionID:  s.ID,
+	}
+}
+
+// writeError tells the browser why a session could not be started or
+// attached. stage says which step failed.
+func writeError(conn *websocket.Conn, stage, message string) {
+	writeControl(conn, serverMessage{Type: msgError, Stage: stage, Message: message})
+}
+
+func writeControl(conn *websocket.Conn, msg serverMessage) {
+	p, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	conn.WriteMessage(websocket.TextMessage, p)
+}
+
+// Registry tracks live sessions so a new websocket can reattach by ID.
+type Registry struct {
+	grace time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+// NewRegistry returns a registry that keeps detached sessions alive for the
+// given grace period.
+func NewRegistry(grace time.Duration) *Registry {
+	return &Registry{
+		grace:    grace,
+		sessions: make(map[string]*Session),
+	}
+}
+
+func (r *Registry) add(s *Session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sessions[s.ID] = s
+}
+
+func (r *Registry) remove(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.sessions, id)
+}
+
+// Len returns the number of live sessions.
+func (r *Registry) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.sessions)
+}
+
+// Get returns the live session with the given ID.
+func (r *Registry) Get(id string) (*Session, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.sessions[id]
+	return s, ok
+}
+
+func newSessionID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// ringBuffer keeps the most recent len(buf) bytes written to it.
+type ringBuffer struct {
+	buf  []byte
+	pos  int
+	full bool
+}
+
+func newRingBuffer(size int) *ringBuffer {
+	return &ringBuffer{buf: make([]byte, size)}
+}
+
+func (b *ringBuffer) Write(p []byte) {
+	size := len(b.buf)
+	if len(p) >= size {
+		copy(b.buf, p[len(p)-size:])
+		b.pos = 0
+		b.full = true
+		return
+	}
+
+	n := copy(b.buf[b.pos:], p)
+	copy(b.buf, p[n:])
+	if b.pos+len(p) >= size {
+		b.full = true
+	}
+	b.pos = (b.pos + len(p)) % size
+}
+
+// Bytes returns the buffered data, oldest first.
+func (b *ringBuffer) Bytes() []byte {
+	if !b.full {
+		return append([]byte(nil), b.buf[:b.pos]...)
+	}
+	return append(append([]byte(nil), b.buf[b.pos:]...), b.buf[:b.pos]...)
+}
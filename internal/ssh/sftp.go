@@ -0,0 +1,32 @@
+package ssh
+
+import (
+	"context"
+
+	"github.com/pkg/sftp"
+)
+
+// OpenSFTP authorizes the caller in ctx and starts the sftp subsystem on
+// machine as user. Closing the returned client does not release the SSH
+// connection; call the returned close function once done with both.
+func (h *SSHHandler) OpenSFTP(ctx context.Context, machine, user string) (*sftp.Client, func(), error) {
+	if err := h.authorize(ctx, machine, user); err != nil {
+		return nil, nil, err
+	}
+
+	client, release, err := h.connect(ctx, machine, user, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sc, err := sftp.NewClient(client)
+	if err != nil {
+		release()
+		return nil, nil, &SetupError{Stage: stageSetup, Message: "Failed to start sftp subsystem", Err: err}
+	}
+
+	return sc, func() {
+		sc.Close()
+		release()
+	}, nil
+}
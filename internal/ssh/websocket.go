@@ -2,30 +2,84 @@ package ssh
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/rajsinghtech/tailtunnel/internal/audit"
+	"github.com/rajsinghtech/tailtunnel/internal/identity"
+	"github.com/rajsinghtech/tailtunnel/internal/policy"
+	"github.com/rajsinghtech/tailtunnel/internal/recording"
 	"golang.org/x/crypto/ssh"
 )
 
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
+	CheckOrigin:     identity.SameOrigin,
+}
+
+// Authorizer decides whether a tailnet caller may open an SSH session to
+// machine as user. A non-nil error explains why not.
+type Authorizer interface {
+	AuthorizeSSH(ctx context.Context, caller *identity.Identity, machine, user string) error
 }
 
 type SSHHandler struct {
 	DialFunc func(ctx context.Context, machine string) (net.Conn, error)
+	HostKeys *HostKeyVerifier
+
+	// Credentials, when set, supplies private keys and certificates for
+	// public key authentication.
+	Credentials Credentials
+
+	// CA, when set, signs a certificate for the caller on every connection.
+	// It is offered before any stored keys.
+	CA CertAuthority
+
+	// Authorizer, when set, is consulted before dialing and before anyone
+	// joins a session as a co-driver.
+	Authorizer Authorizer
+
+	// Audit, when set, receives session start, end, join and denial events.
+	Audit *audit.Logger
+
+	// Sessions tracks live sessions so they can be reattached.
+	Sessions *Registry
+
+	// Pool, when set, shares one SSH connection between a caller's
+	// sessions to the same machine and user.
+	Pool *Pool
+
+	// Recordings, when set, receives an asciicast recording of every session.
+	Recordings *recording.Store
+
+	gatewaySessions atomic.Int64
 }
 
-func (h *SSHHandler) HandleWebSocket(w http.ResponseWriter, r *http.Request, machine string, user string) {
+// ActiveSessions returns the number of live browser terminal sessions and
+// of open session channels from SSH gateway clients.
+func (h *SSHHandler) ActiveSessions() (browser, gateway int) {
+	return h.Sessions.Len(), int(h.gatewaySessions.Load())
+}
+
+// HandleWebSocket bridges a browser terminal to an interactive SSH session.
+// The tailnet caller attached by identity.Middleware owns the session and is
+// recorded in recording metadata. Passing a "session" query parameter
+// attaches to a session that is still alive instead of starting a new one:
+// the owner reattaches, while "mode=view" or "mode=drive" joins it as a
+// read-only viewer or a co-driver, if the owner has shared it with the
+// caller and the policy lets the caller log in to the machine as the
+// session's user.
+func (h *SSHHandler) HandleWebSocket(w http.ResponseWriter, r *http.Request, machine, user string) {
+	caller := identity.OwnerName(r.Context())
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("Failed to upgrade websocket: %v", err)
@@ -33,56 +87,134 @@ func (h *SSHHandler) HandleWebSocket(w http.ResponseWriter, r *http.Request, mac
 	}
 	defer conn.Close()
 
-	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
-	defer cancel()
-
-	netConn, err := h.DialFunc(ctx, machine)
-	if err != nil {
-		conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("Failed to dial machine: %v\r\n", err)))
+	var s *Session
+	var p *Participant
+	if id := r.URL.Query().Get("session"); id != "" {
+		s, p = h.reattach(conn, r, id, caller)
+	} else {
+		s, p = h.startSession(conn, r, machine, user, caller)
+	}
+	if s == nil {
 		return
 	}
-	defer netConn.Close()
 
-	config := &ssh.ClientConfig{
-		User: user,
-		Auth: []ssh.AuthMethod{},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		Timeout: 10 * time.Second,
+	h.readLoop(conn, s, p)
+}
+
+func (h *SSHHandler) reattach(conn *websocket.Conn, r *http.Request, id, caller string) (*Session, *Participant) {
+	q := r.URL.Query()
+	mode := q.Get("mode")
+
+	s, ok := h.Sessions.Get(id)
+	if !ok || (mode == "" && s.Identity != caller) {
+		writeError(conn, stageSession, "Session not found or expired")
+		return nil, nil
+	}
+
+	// Watching a session shows everything the remote user sees, so it
+	// needs the same access as logging in.
+	if mode != "" {
+		if err := h.authorize(r.Context(), s.Machine, s.User); err != nil {
+			writeError(conn, stagePolicy, "Access denied: "+denialReason(err))
+			return nil, nil
+		}
 	}
 
-	sshConn, chans, reqs, err := ssh.NewClientConn(netConn, machine+":22", config)
+	var p *Participant
+	var err error
+	switch mode {
+	case "":
+		p, err = s.attach(conn)
+	case "view", "drive":
+		p, err = s.join(conn, caller, mode == "drive")
+	default:
+		writeError(conn, stageSession, fmt.Sprintf("Unknown session mode %q", mode))
+		return nil, nil
+	}
 	if err != nil {
-		conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("Failed to create SSH connection: %v\r\n", err)))
-		return
+		writeError(conn, stageSession, fmt.Sprintf("Failed to attach to session: %v", err))
+		return nil, nil
 	}
-	defer sshConn.Close()
 
-	client := ssh.NewClient(sshConn, chans, reqs)
-	defer client.Close()
+	if p.Role != RoleOwner {
+		ev := s.auditEvent(audit.ActionSSHJoin)
+		ev.User = identity.LoginName(r.Context())
+		ev.Node = callerNode(r)
+		ev.Details = map[string]any{"role": p.Role, "owner": s.Identity}
+		h.Audit.Log(ev)
+	}
+
+	if p.Role == RoleOwner {
+		if q.Get("cols") != "" && q.Get("rows") != "" {
+			cols, rows := termSize(q)
+			handleControl(s, &controlMessage{Type: msgResize, Cols: cols, Rows: rows})
+		}
+		log.Printf("SSH session %s reattached", s.ID)
+	}
+
+	return s, p
+}
+
+func (h *SSHHandler) startSession(conn *websocket.Conn, r *http.Request, machine, user, caller string) (*Session, *Participant) {
+	if err := h.authorize(r.Context(), machine, user); err != nil {
+		writeError(conn, stagePolicy, "Access denied: "+denialReason(err))
+		return nil, nil
+	}
+
+	// fail reports a setup error to the browser and the audit log.
+	fail := func(stage, msg string, err error) (*Session, *Participant) {
+		writeError(conn, stage, fmt.Sprintf("%s: %v", msg, err))
+		ev := audit.NewEvent(r.Context(), audit.ActionSSHStart)
+		ev.Outcome = audit.OutcomeFailure
+		ev.Machine = machine
+		ev.RemoteUser = user
+		ev.Reason = fmt.Sprintf("%s: %v", msg, err)
+		h.Audit.Log(ev)
+		return nil, nil
+	}
+
+	client, release, err := h.connect(r.Context(), machine, user, &wsPrompter{conn: conn})
+	if err != nil {
+		var setupErr *SetupError
+		if errors.As(err, &setupErr) {
+			if setupErr.Stage == stageHostKey {
+				log.Printf("Refusing SSH connection: %v", setupErr.Err)
+			}
+			return fail(setupErr.Stage, setupErr.Message, setupErr.Err)
+		}
+		return fail(stageDial, "Failed to connect", err)
+	}
 
 	session, err := client.NewSession()
 	if err != nil {
-		conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("Failed to create SSH session: %v\r\n", err)))
-		return
+		release()
+		return fail(stageSetup, "Failed to create SSH session", err)
 	}
-	defer session.Close()
+
+	// Closing the session tears down everything layered on top of it, so
+	// with the connection it is the only cleanup needed if setup fails
+	// part way.
+	started := false
+	defer func() {
+		if !started {
+			session.Close()
+			release()
+		}
+	}()
 
 	stdin, err := session.StdinPipe()
 	if err != nil {
-		conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("Failed to get stdin: %v\r\n", err)))
-		return
+		return fail(stageSetup, "Failed to get stdin", err)
 	}
 
 	stdout, err := session.StdoutPipe()
 	if err != nil {
-		conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("Failed to get stdout: %v\r\n", err)))
-		return
+		return fail(stageSetup, "Failed to get stdout", err)
 	}
 
 	stderr, err := session.StderrPipe()
 	if err != nil {
-		conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("Failed to get stderr: %v\r\n", err)))
-		return
+		return fail(stageSetup, "Failed to get stderr", err)
 	}
 
 	modes := ssh.TerminalModes{
@@ -91,64 +223,168 @@ func (h *SSHHandler) HandleWebSocket(w http.ResponseWriter, r *http.Request, mac
 		ssh.TTY_OP_OSPEED: 14400,
 	}
 
-	if err := session.RequestPty("xterm-256color", 80, 24, modes); err != nil {
-		conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("Failed to request PTY: %v\r\n", err)))
-		return
+	cols, rows := termSize(r.URL.Query())
+	if err := session.RequestPty("xterm-256color", rows, cols, modes); err != nil {
+		return fail(stageSetup, "Failed to request PTY", err)
+	}
+
+	var rec *recording.Recorder
+	var recordingID string
+	if h.Recordings != nil {
+		id, recorder, err := h.Recordings.Create(recording.Metadata{
+			Machine:  machine,
+			User:     user,
+			Identity: caller,
+		}, cols, rows)
+		if err != nil {
+			return fail(stageSetup, "Failed to start recording", err)
+		}
+		log.Printf("Recording SSH session %s@%s to %s", user, machine, id)
+		rec = recorder
+		recordingID = id
 	}
 
 	if err := session.Shell(); err != nil {
-		conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("Failed to start shell: %v\r\n", err)))
-		return
+		rec.Close()
+		return fail(stageSetup, "Failed to start shell", err)
 	}
+	started = true
 
-	done := make(chan struct{})
+	s := &Session{
+		ID:         newSessionID(),
+		Machine:    machine,
+		User:       user,
+		Identity:   caller,
+		CreatedAt:  time.Now(),
+		login:      identity.LoginName(r.Context()),
+		node:       callerNode(r),
+		registry:   h.Sessions,
+		audit:      h.Audit,
+		release:    release,
+		session:    session,
+		stdin:      stdin,
+		rec:        rec,
+		scrollback: newRingBuffer(defaultScrollback),
+		viewers:    make(map[string]*Participant),
+	}
+	h.Sessions.add(s)
+	p, _ := s.attach(conn)
+
+	ev := s.auditEvent(audit.ActionSSHStart)
+	ev.Details = map[string]any{"cols": cols, "rows": rows}
+	if recordingID != "" {
+		ev.Details["recording"] = recordingID
+	}
+	h.Audit.Log(ev)
 
+	var pumps sync.WaitGroup
+	pumps.Add(2)
 	go func() {
-		defer close(done)
-		buf := make([]byte, 32*1024)
-		for {
-			n, err := stdout.Read(buf)
-			if err != nil {
-				if err != io.EOF {
-					log.Printf("SSH stdout read error: %v", err)
-				}
-				return
-			}
-			if err := conn.WriteMessage(websocket.BinaryMessage, buf[:n]); err != nil {
-				log.Printf("WebSocket write error: %v", err)
-				return
-			}
-		}
+		defer pumps.Done()
+		s.pump(stdout, "stdout")
 	}()
-
 	go func() {
-		buf := make([]byte, 32*1024)
-		for {
-			n, err := stderr.Read(buf)
-			if err != nil {
-				if err != io.EOF {
-					log.Printf("SSH stderr read error: %v", err)
-				}
-				return
-			}
-			if err := conn.WriteMessage(websocket.BinaryMessage, buf[:n]); err != nil {
-				log.Printf("WebSocket write error: %v", err)
-				return
-			}
-		}
+		defer pumps.Done()
+		s.pump(stderr, "stderr")
+	}()
+	go func() {
+		pumps.Wait()
+		s.closeWithReason(reasonExited, session.Wait())
 	}()
 
+	return s, p
+}
+
+func (h *SSHHandler) authorize(ctx context.Context, machine, user string) error {
+	if h.Authorizer == nil {
+		return nil
+	}
+	caller := identity.FromContext(ctx)
+	if err := h.Authorizer.AuthorizeSSH(ctx, caller, machine, user); err != nil {
+		log.Printf("Denied SSH to %s@%s for %s: %v", user, machine, identity.LoginName(ctx), err)
+		ev := audit.NewEvent(ctx, audit.ActionSSHDenied)
+		ev.Outcome = audit.OutcomeDenied
+		ev.Machine = machine
+		ev.RemoteUser = user
+		ev.Reason = denialReason(err)
+		h.Audit.Log(ev)
+		return err
+	}
+	return nil
+}
+
+func callerNode(r *http.Request) string {
+	if id := identity.FromContext(r.Context()); id != nil {
+		return id.NodeName
+	}
+	return ""
+}
+
+// denialReason strips the generic prefix from policy errors so the terminal
+// shows just the reason.
+func denialReason(err error) string {
+	var denied *policy.DeniedError
+	if errors.As(err, &denied) {
+		return denied.Reason
+	}
+	return err.Error()
+}
+
+// readLoop forwards input from conn to the session until the websocket
+// closes, at which point the participant is detached and the session stays
+// alive. Input from read-only viewers is dropped.
+func (h *SSHHandler) readLoop(conn *websocket.Conn, s *Session, p *Participant) {
+	defer s.detach(p)
+
 	for {
-		messageType, p, err := conn.ReadMessage()
+		messageType, data, err := conn.ReadMessage()
 		if err != nil {
 			log.Printf("WebSocket read error: %v", err)
 			return
 		}
+		if messageType == websocket.TextMessage {
+			if msg, ok := parseControlMessage(data); ok {
+				switch {
+				case msg.Type == msgResize && p.Role == RoleOwner:
+					handleControl(s, msg)
+				case msg.Type == msgSignal && s.canWrite(p):
+					handleControl(s, msg)
+				}
+				continue
+			}
+		}
+		if !s.canWrite(p) {
+			continue
+		}
 		if messageType == websocket.TextMessage || messageType == websocket.BinaryMessage {
-			if _, err := stdin.Write(p); err != nil {
+			s.rec.Input(data)
+			s.bytesIn.Add(int64(len(data)))
+			if _, err := s.stdin.Write(data); err != nil {
 				log.Printf("SSH stdin write error: %v", err)
 				return
 			}
 		}
 	}
 }
+
+func handleControl(s *Session, msg *controlMessage) {
+	switch msg.Type {
+	case msgResize:
+		if msg.Cols <= 0 || msg.Rows <= 0 || msg.Cols > maxDim || msg.Rows > maxDim {
+			return
+		}
+		if err := s.session.WindowChange(msg.Rows, msg.Cols); err != nil {
+			log.Printf("SSH window change error: %v", err)
+			return
+		}
+		s.rec.Resize(msg.Cols, msg.Rows)
+	case msgSignal:
+		sig, ok := allowedSignals[msg.Signal]
+		if !ok {
+			return
+		}
+		if err := s.session.Signal(sig); err != nil {
+			log.Printf("SSH signal error: %v", err)
+		}
+	}
+}
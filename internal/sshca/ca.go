@@ -0,0 +1,175 @@
+package sshca
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rajsinghtech/tailtunnel/internal/audit"
+	"github.com/rajsinghtech/tailtunnel/internal/identity"
+	"github.com/rajsinghtech/tailtunnel/internal/policy"
+	"golang.org/x/crypto/ssh"
+)
+
+// clockSkew backdates certificates so hosts with slightly slow clocks
+// accept them.
+const clockSkew = time.Minute
+
+// Granter decides what a certificate may carry. It matches
+// (*policy.Engine).GrantCert.
+type Granter interface {
+	GrantCert(ctx context.Context, caller *identity.Identity, machine, user string) (*policy.CertGrant, error)
+}
+
+// CA issues short-lived OpenSSH user certificates for the tailnet caller
+// of each connection. Hosts trust it by adding the public key to
+// TrustedUserCAKeys in sshd_config.
+type CA struct {
+	signer ssh.Signer
+	ttl    time.Duration
+	policy Granter
+	audit  *audit.Logger
+}
+
+// Load reads the CA private key from path, generating an ed25519 key there
+// on first use. Certificates are valid for ttl and carry what policy grants.
+func Load(path string, ttl time.Duration, policy Granter, audit *audit.Logger) (*CA, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		data, err = generate(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SSH CA key %s: %w", path, err)
+	}
+
+	return &CA{signer: signer, ttl: ttl, policy: policy, audit: audit}, nil
+}
+
+func generate(path string) ([]byte, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "tailtunnel-ca")
+	if err != nil {
+		return nil, err
+	}
+	data := pem.EncodeToMemory(block)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create SSH CA directory: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return nil, fmt.Errorf("failed to write SSH CA key: %w", err)
+	}
+	log.Printf("Created SSH CA key %s", path)
+	return data, nil
+}
+
+// PublicKey returns the CA public key in authorized_keys format.
+func (ca *CA) PublicKey() string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(ca.signer.PublicKey()))) + " tailtunnel-ca"
+}
+
+// Sign mints an ephemeral key and a certificate for it that lets the
+// caller in ctx log in to machine as user. The policy decides the
+// certificate's principals and whether it permits agent forwarding and
+// ~/.ssh/rc; its key ID names the caller for the host's auth log.
+func (ca *CA) Sign(ctx context.Context, machine, user string) (ssh.Signer, error) {
+	caller := identity.FromContext(ctx)
+	if caller == nil {
+		return nil, errors.New("caller could not be identified")
+	}
+	grant, err := ca.policy.GrantCert(ctx, caller, machine, user)
+	if err != nil {
+		return nil, err
+	}
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		return nil, err
+	}
+
+	var serial [8]byte
+	if _, err := rand.Read(serial[:]); err != nil {
+		return nil, err
+	}
+
+	extensions := map[string]string{
+		"permit-pty":             "",
+		"permit-port-forwarding": "",
+	}
+	if grant.AgentForwarding {
+		extensions["permit-agent-forwarding"] = ""
+	}
+	if grant.UserRC {
+		extensions["permit-user-rc"] = ""
+	}
+
+	now := time.Now()
+	cert := &ssh.Certificate{
+		Key:             signer.PublicKey(),
+		Serial:          binary.BigEndian.Uint64(serial[:]),
+		CertType:        ssh.UserCert,
+		KeyId:           keyID(caller),
+		ValidPrincipals: grant.Principals,
+		ValidAfter:      uint64(now.Add(-clockSkew).Unix()),
+		ValidBefore:     uint64(now.Add(ca.ttl).Unix()),
+		Permissions:     ssh.Permissions{Extensions: extensions},
+	}
+	if err := cert.SignCert(rand.Reader, ca.signer); err != nil {
+		return nil, fmt.Errorf("failed to sign certificate: %w", err)
+	}
+
+	ev := audit.NewEvent(ctx, audit.ActionCertIssued)
+	ev.Outcome = audit.OutcomeSuccess
+	ev.Machine = machine
+	ev.RemoteUser = user
+	ev.Details = map[string]any{
+		"serial":      fmt.Sprintf("%d", cert.Serial),
+		"keyId":       cert.KeyId,
+		"principals":  cert.ValidPrincipals,
+		"extensions":  slices.Sorted(maps.Keys(extensions)),
+		"fingerprint": ssh.FingerprintSHA256(cert.Key),
+		"validBefore": time.Unix(int64(cert.ValidBefore), 0).UTC(),
+	}
+	ca.audit.Log(ev)
+
+	return ssh.NewCertSigner(cert, signer)
+}
+
+func keyID(caller *identity.Identity) string {
+	name := caller.LoginName
+	if caller.IsTagged() {
+		name = strings.Join(caller.Tags, ",")
+	}
+	return fmt.Sprintf("tailtunnel:%s:%s", name, caller.NodeName)
+}
+
+// ServePublicKey responds with the CA public key as plain text, ready to
+// be saved to the file TrustedUserCAKeys points at.
+func (ca *CA) ServePublicKey(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, ca.PublicKey())
+}
@@ -7,6 +7,7 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -271,8 +272,63 @@ func (tc *TailscaleClient) ListenHTTPS(handler http.Handler) error {
 	return http.Serve(httpListener, handler)
 }
 
+// ServeOn serves handler on port of TailTunnel's tailnet addresses, over
+// HTTPS whenever ListenHTTPS serves HTTPS. Pages served there have an origin
+// of their own, apart from the ones ListenHTTPS serves.
+func (tc *TailscaleClient) ServeOn(port int, handler http.Handler) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	status, err := tc.Up(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to bring up tailscale: %w", err)
+	}
+
+	addr := ":" + strconv.Itoa(port)
+	var ln net.Listener
+	if status.Self.HasCap(tailcfg.CapabilityHTTPS) && len(tc.server.CertDomains()) > 0 {
+		ln, err = tc.server.ListenTLS("tcp", addr)
+	} else {
+		ln, err = tc.server.Listen("tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	return http.Serve(ln, handler)
+}
+
 func (tc *TailscaleClient) DialSSH(ctx context.Context, machine string) (net.Conn, error) {
-	return tc.server.Dial(ctx, "tcp", machine+":22")
+	return tc.Dial(ctx, machine, 22)
+}
+
+// Dial opens a TCP connection to port on machine through the tailnet.
+func (tc *TailscaleClient) Dial(ctx context.Context, machine string, port int) (net.Conn, error) {
+	return tc.server.Dial(ctx, "tcp", net.JoinHostPort(machine, strconv.Itoa(port)))
+}
+
+// Listen accepts TCP connections on port of TailTunnel's own tailnet
+// addresses.
+func (tc *TailscaleClient) Listen(port int) (net.Listener, error) {
+	return tc.server.Listen("tcp", ":"+strconv.Itoa(port))
+}
+
+// SelfDNSName returns TailTunnel's own MagicDNS name without the trailing
+// dot.
+func (tc *TailscaleClient) SelfDNSName(ctx context.Context) (string, error) {
+	status, err := tc.lc.StatusWithoutPeers(ctx)
+	if err != nil {
+		return "", err
+	}
+	if status.Self == nil {
+		return "", fmt.Errorf("tailscale is not running")
+	}
+	return strings.TrimSuffix(status.Self.DNSName, "."), nil
+}
+
+// StateDir returns the directory holding tsnet state. TailTunnel keeps its
+// own persistent files (known_hosts, recordings, ...) alongside it.
+func (tc *TailscaleClient) StateDir() string {
+	return tc.server.Dir
 }
 
 func (tc *TailscaleClient) LocalClient() *tailscale.LocalClient {
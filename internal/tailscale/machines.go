@@ -2,7 +2,12 @@ package tailscale
 
 import (
 	"context"
+	"fmt"
 	"net/netip"
+	"sort"
+	"strings"
+
+	"tailscale.com/ipn/ipnstate"
 )
 
 type Machine struct {
@@ -32,30 +37,7 @@ func (tc *TailscaleClient) GetSSHMachines(ctx context.Context) (*MachineListResp
 	var machines []Machine
 	for _, peer := range status.Peer {
 		if len(peer.SSH_HostKeys) > 0 {
-			tags := []string{}
-			if peer.Tags != nil {
-				tags = peer.Tags.AsSlice()
-			}
-
-			userLogin := ""
-			userDisplay := ""
-			if userProfile, ok := status.User[peer.UserID]; ok {
-				userLogin = userProfile.LoginName
-				userDisplay = userProfile.DisplayName
-			}
-
-			machines = append(machines, Machine{
-				NodeKey:      peer.PublicKey.String(),
-				HostName:     peer.HostName,
-				DNSName:      peer.DNSName,
-				TailscaleIPs: formatIPs(peer.TailscaleIPs),
-				OS:           peer.OS,
-				Online:       peer.Online,
-				SSHHostKeys:  peer.SSH_HostKeys,
-				Tags:         tags,
-				UserLogin:    userLogin,
-				UserDisplay:  userDisplay,
-			})
+			machines = append(machines, machineFromPeer(status, peer))
 		}
 	}
 
@@ -93,6 +75,89 @@ func (tc *TailscaleClient) GetSSHMachines(ctx context.Context) (*MachineListResp
 	}, nil
 }
 
+// FindMachine looks up a peer by MagicDNS name, short MagicDNS name or
+// Tailscale IP, which are unique in the tailnet. Failing that it looks for a
+// peer with the given hostname, which several peers may share, so it is an
+// error if more than one does.
+// Unlike GetSSHMachines it also returns peers that publish no SSH host keys.
+func (tc *TailscaleClient) FindMachine(ctx context.Context, name string) (*Machine, error) {
+	status, err := tc.lc.Status(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	var byHost []*ipnstate.PeerStatus
+	for _, peer := range status.Peer {
+		if peerMatches(peer, name) {
+			m := machineFromPeer(status, peer)
+			return &m, nil
+		}
+		if name == strings.ToLower(peer.HostName) {
+			byHost = append(byHost, peer)
+		}
+	}
+
+	switch len(byHost) {
+	case 0:
+		return nil, fmt.Errorf("machine %q not found in tailnet", name)
+	case 1:
+		m := machineFromPeer(status, byHost[0])
+		return &m, nil
+	}
+	names := make([]string, len(byHost))
+	for i, peer := range byHost {
+		names[i] = strings.TrimSuffix(peer.DNSName, ".")
+	}
+	sort.Strings(names)
+	return nil, fmt.Errorf("hostname %q is ambiguous, use one of the MagicDNS names %s", name, strings.Join(names, ", "))
+}
+
+// peerMatches reports whether name is the peer's MagicDNS name, the first
+// label of it, or one of its Tailscale IPs.
+func peerMatches(peer *ipnstate.PeerStatus, name string) bool {
+	dnsName := strings.ToLower(strings.TrimSuffix(peer.DNSName, "."))
+	if name == dnsName {
+		return true
+	}
+	if short, _, ok := strings.Cut(dnsName, "."); ok && name == short {
+		return true
+	}
+	for _, ip := range peer.TailscaleIPs {
+		if ip.String() == name {
+			return true
+		}
+	}
+	return false
+}
+
+func machineFromPeer(status *ipnstate.Status, peer *ipnstate.PeerStatus) Machine {
+	tags := []string{}
+	if peer.Tags != nil {
+		tags = peer.Tags.AsSlice()
+	}
+
+	userLogin := ""
+	userDisplay := ""
+	if userProfile, ok := status.User[peer.UserID]; ok {
+		userLogin = userProfile.LoginName
+		userDisplay = userProfile.DisplayName
+	}
+
+	return Machine{
+		NodeKey:      peer.PublicKey.String(),
+		HostName:     peer.HostName,
+		DNSName:      peer.DNSName,
+		TailscaleIPs: formatIPs(peer.TailscaleIPs),
+		OS:           peer.OS,
+		Online:       peer.Online,
+		SSHHostKeys:  peer.SSH_HostKeys,
+		Tags:         tags,
+		UserLogin:    userLogin,
+		UserDisplay:  userDisplay,
+	}
+}
+
 func formatIPs(ips []netip.Addr) []string {
 	result := make([]string, len(ips))
 	for i, ip := range ips {
@@ -100,3 +165,14 @@ func formatIPs(ips []netip.Addr) []string {
 	}
 	return result
 }
+
+// SSHHostKeys returns the SSH host keys the given peer publishes in the
+// netmap, in authorized_keys format. Peers that don't run Tailscale SSH
+// publish none.
+func (tc *TailscaleClient) SSHHostKeys(ctx context.Context, machine string) ([]string, error) {
+	m, err := tc.FindMachine(ctx, machine)
+	if err != nil {
+		return nil, err
+	}
+	return m.SSHHostKeys, nil
+}
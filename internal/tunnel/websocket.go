@@ -0,0 +1,230 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rajsinghtech/tailtunnel/internal/audit"
+	"github.com/rajsinghtech/tailtunnel/internal/identity"
+	"github.com/rajsinghtech/tailtunnel/internal/policy"
+)
+
+const dialTimeout = 30 * time.Second
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  32 * 1024,
+	WriteBufferSize: 32 * 1024,
+	// noVNC and websockify clients ask for the "binary" subprotocol.
+	Subprotocols: []string{"binary"},
+	CheckOrigin:  identity.SameOrigin,
+}
+
+// Authorizer decides whether a tailnet caller may open a TCP connection to
+// port on machine. A non-nil error explains why not.
+type Authorizer interface {
+	AuthorizePort(ctx context.Context, caller *identity.Identity, machine string, port int) error
+}
+
+// Handler bridges websockets to TCP ports on tailnet peers.
+type Handler struct {
+	Dial func(ctx context.Context, machine string, port int) (net.Conn, error)
+
+	// Forward opens a connection to addr as seen from machine over SSH,
+	// authorizing the caller in ctx as the remote user.
+	Forward func(ctx context.Context, machine, user, addr string) (net.Conn, error)
+
+	// Authorizer, when set, is consulted before dialing.
+	Authorizer Authorizer
+
+	// Audit, when set, receives an event for every tunnel with the bytes
+	// carried in each direction.
+	Audit *audit.Logger
+}
+
+// HandleWebSocket dials port on machine and pipes bytes between it and the
+// websocket. Data from the peer is sent as binary frames; both binary and
+// text frames from the client are written to the peer as-is.
+func (h *Handler) HandleWebSocket(w http.ResponseWriter, r *http.Request, machine, portParam string) {
+	port, err := parsePort(portParam)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ev := audit.NewEvent(r.Context(), audit.ActionTCPTunnel)
+	ev.Machine = machine
+	ev.Details = map[string]any{"port": port}
+
+	if err := h.authorize(r.Context(), machine, port); err != nil {
+		log.Printf("Denied TCP to %s:%d for %s: %v", machine, port, identity.LoginName(r.Context()), err)
+		h.deny(w, ev, err)
+		return
+	}
+
+	h.bridge(w, r, ev, func(ctx context.Context) (net.Conn, error) {
+		return h.Dial(ctx, machine, port)
+	})
+}
+
+// HandleForward is HandleWebSocket for a "host" and "port" reached through
+// an SSH direct-tcpip channel on machine, logged in as "user". Host defaults
+// to localhost, so services listening only on the machine's loopback are
+// reachable. Access follows the SSH policy for user rather than port rules.
+func (h *Handler) HandleForward(w http.ResponseWriter, r *http.Request, machine string) {
+	q := r.URL.Query()
+	port, err := parsePort(q.Get("port"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	host := q.Get("host")
+	if host == "" {
+		host = "localhost"
+	}
+	user := q.Get("user")
+	if user == "" {
+		user = "root"
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+
+	ev := audit.NewEvent(r.Context(), audit.ActionTCPTunnel)
+	ev.Machine = machine
+	ev.RemoteUser = user
+	ev.Details = map[string]any{"port": port, "forward": addr}
+
+	h.bridge(w, r, ev, func(ctx context.Context) (net.Conn, error) {
+		return h.Forward(ctx, machine, user, addr)
+	})
+}
+
+// bridge dials with dial and, once connected, upgrades the request and
+// pipes bytes until either side closes. ev is logged with the outcome.
+func (h *Handler) bridge(w http.ResponseWriter, r *http.Request, ev audit.Event, dial func(ctx context.Context) (net.Conn, error)) {
+	ctx, cancel := context.WithTimeout(r.Context(), dialTimeout)
+	target, err := dial(ctx)
+	cancel()
+	if err != nil {
+		var denied *policy.DeniedError
+		if errors.As(err, &denied) {
+			h.deny(w, ev, err)
+			return
+		}
+		log.Printf("Failed to open tunnel to %s: %v", ev.Machine, err)
+		ev.Outcome = audit.OutcomeFailure
+		ev.Reason = err.Error()
+		h.Audit.Log(ev)
+		http.Error(w, fmt.Sprintf("Failed to connect to %s: %v", ev.Machine, err), http.StatusBadGateway)
+		return
+	}
+	defer target.Close()
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("Failed to upgrade websocket: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	bytesIn, bytesOut := pipe(conn, target)
+
+	ev.Outcome = audit.OutcomeSuccess
+	ev.Details["bytesIn"] = bytesIn
+	ev.Details["bytesOut"] = bytesOut
+	ev.Details["durationMs"] = time.Since(start).Milliseconds()
+	h.Audit.Log(ev)
+
+	log.Printf("Tunnel to %s closed (%d bytes in, %d bytes out)", ev.Machine, bytesIn, bytesOut)
+}
+
+func (h *Handler) deny(w http.ResponseWriter, ev audit.Event, err error) {
+	ev.Outcome = audit.OutcomeDenied
+	ev.Reason = err.Error()
+	var denied *policy.DeniedError
+	if errors.As(err, &denied) {
+		ev.Reason = denied.Reason
+	}
+	h.Audit.Log(ev)
+	http.Error(w, err.Error(), http.StatusForbidden)
+}
+
+func (h *Handler) authorize(ctx context.Context, machine string, port int) error {
+	if h.Authorizer == nil {
+		return nil
+	}
+	return h.Authorizer.AuthorizePort(ctx, identity.FromContext(ctx), machine, port)
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return port, nil
+}
+
+// pipe copies between conn and target until either side closes, then closes
+// both. It returns the bytes sent to target (in) and to conn (out).
+func pipe(conn *websocket.Conn, target net.Conn) (in, out int64) {
+	var bytesIn, bytesOut atomic.Int64
+	var once sync.Once
+	closeBoth := func() {
+		once.Do(func() {
+			conn.Close()
+			target.Close()
+		})
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer closeBoth()
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if messageType != websocket.BinaryMessage && messageType != websocket.TextMessage {
+				continue
+			}
+			if _, err := target.Write(data); err != nil {
+				return
+			}
+			bytesIn.Add(int64(len(data)))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		defer closeBoth()
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := target.Read(buf)
+			if n > 0 {
+				if err := conn.WriteMessage(websocket.BinaryMessage, buf[:n]); err != nil {
+					return
+				}
+				bytesOut.Add(int64(n))
+			}
+			if err != nil {
+				if err != io.EOF {
+					log.Printf("TCP tunnel read error: %v", err)
+				}
+				return
+			}
+		}
+	}()
+	wg.Wait()
+
+	return bytesIn.Load(), bytesOut.Load()
+}
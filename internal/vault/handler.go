@@ -0,0 +1,112 @@
+package vault
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rajsinghtech/tailtunnel/internal/audit"
+	"github.com/rajsinghtech/tailtunnel/internal/identity"
+)
+
+// Handler serves the key management API. Responses only ever contain key
+// metadata; private keys are write-only. Only admins may add keys; keys can
+// be changed or removed by whoever added them and by admins.
+type Handler struct {
+	vault   *Vault
+	audit   *audit.Logger
+	isAdmin func(*identity.Identity) bool
+}
+
+func NewHandler(vault *Vault, audit *audit.Logger, isAdmin func(*identity.Identity) bool) *Handler {
+	return &Handler{vault: vault, audit: audit, isAdmin: isAdmin}
+}
+
+func (h *Handler) List(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.vault.List())
+}
+
+// Create imports the private key in the JSON-encoded Import in the body.
+func (h *Handler) Create(w http.ResponseWriter, r *http.Request) {
+	if !h.isAdmin(identity.FromContext(r.Context())) {
+		http.Error(w, "Only TailTunnel admins may add keys", http.StatusForbidden)
+		return
+	}
+
+	var imp Import
+	if err := json.NewDecoder(r.Body).Decode(&imp); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	key, err := h.vault.Add(imp, identity.OwnerName(r.Context()))
+	if err != nil {
+		log.Printf("Failed to import key: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.log(r, "create", key)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(key)
+}
+
+// Update replaces a key's bindings with the JSON-encoded Binding in the body.
+func (h *Handler) Update(w http.ResponseWriter, r *http.Request) {
+	var b Binding
+	if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	key, err := h.vault.Update(chi.URLParam(r, "id"), b, identity.OwnerName(r.Context()), h.isAdmin(identity.FromContext(r.Context())))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	h.log(r, "update", key)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(key)
+}
+
+func (h *Handler) Delete(w http.ResponseWriter, r *http.Request) {
+	key, err := h.vault.Delete(chi.URLParam(r, "id"), identity.OwnerName(r.Context()), h.isAdmin(identity.FromContext(r.Context())))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	h.log(r, "delete", key)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) log(r *http.Request, op string, key *Key) {
+	ev := audit.NewEvent(r.Context(), audit.ActionKeyChange)
+	ev.Outcome = audit.OutcomeSuccess
+	ev.Details = map[string]any{
+		"op":          op,
+		"key":         key.ID,
+		"name":        key.Name,
+		"fingerprint": key.Fingerprint,
+		"machines":    key.Machines,
+	}
+	h.audit.Log(ev)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, ErrNotOwner) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	log.Printf("Key vault error: %v", err)
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
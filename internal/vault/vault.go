@@ -0,0 +1,433 @@
+package vault
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rajsinghtech/tailtunnel/internal/policy"
+	"github.com/rajsinghtech/tailtunnel/internal/tailscale"
+	"golang.org/x/crypto/ssh"
+)
+
+const masterKeySize = 32
+
+// ErrNotFound is returned for unknown key IDs.
+var ErrNotFound = errors.New("key not found")
+
+// ErrNotOwner is returned when changing a key added by someone else.
+var ErrNotOwner = errors.New("key was added by someone else")
+
+// Key describes a stored private key and the machines it is used for. It
+// never includes the private key itself.
+type Key struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Fingerprint string `json:"fingerprint"`
+	PublicKey   string `json:"publicKey"`
+
+	// Certificate is an OpenSSH user certificate for the key, in
+	// authorized_keys format, presented in addition to the bare key.
+	Certificate     string     `json:"certificate,omitempty"`
+	CertPrincipals  []string   `json:"certPrincipals,omitempty"`
+	CertValidBefore *time.Time `json:"certValidBefore,omitempty"`
+
+	// Machines the key is offered to: hostnames, MagicDNS names, Tailscale
+	// IPs, "tag:<name>" or "*", as in policy rules. Users limits it to those
+	// remote usernames; empty means any.
+	Machines []string `json:"machines"`
+	Users    []string `json:"users,omitempty"`
+
+	CreatedBy string    `json:"createdBy,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Import is a private key to add to the vault.
+type Import struct {
+	Name        string   `json:"name"`
+	PrivateKey  string   `json:"privateKey"`
+	Passphrase  string   `json:"passphrase,omitempty"`
+	Certificate string   `json:"certificate,omitempty"`
+	Machines    []string `json:"machines"`
+	Users       []string `json:"users,omitempty"`
+}
+
+// Binding changes which machines and users a key is used for.
+type Binding struct {
+	Name     *string  `json:"name,omitempty"`
+	Machines []string `json:"machines"`
+	Users    []string `json:"users,omitempty"`
+}
+
+type storedKey struct {
+	Key
+	PrivateKey string `json:"privateKey"`
+}
+
+// Vault keeps SSH private keys and certificates encrypted at rest with
+// AES-256-GCM. The master key lives in its own file so it can be kept
+// apart from the vault, for example in a mounted secret.
+type Vault struct {
+	path          string
+	lookupMachine func(ctx context.Context, machine string) (*tailscale.Machine, error)
+	aead          cipher.AEAD
+
+	mu   sync.Mutex
+	keys []storedKey
+}
+
+// Open loads the vault at path, creating the master key at keyPath if it
+// doesn't exist yet.
+func Open(path, keyPath string, lookupMachine func(ctx context.Context, machine string) (*tailscale.Machine, error)) (*Vault, error) {
+	masterKey, err := loadMasterKey(keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &Vault{path: path, lookupMachine: lookupMachine, aead: aead}
+	if err := v.load(); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func loadMasterKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(key) != masterKeySize {
+			return nil, fmt.Errorf("invalid vault key in %s, expected %d hex-encoded bytes", path, masterKeySize)
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read vault key: %w", err)
+	}
+
+	key := make([]byte, masterKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create vault key directory: %w", err)
+	}
+	if err := os.WriteFile(path, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+		return nil, fmt.Errorf("failed to write vault key: %w", err)
+	}
+	log.Printf("Created vault key %s", path)
+	return key, nil
+}
+
+func (v *Vault) load() error {
+	data, err := os.ReadFile(v.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read vault: %w", err)
+	}
+
+	nonceSize := v.aead.NonceSize()
+	if len(data) < nonceSize {
+		return fmt.Errorf("vault %s is corrupt", v.path)
+	}
+	plaintext, err := v.aead.Open(nil, data[:nonceSize], data[nonceSize:], nil)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt vault %s, is the vault key correct? %w", v.path, err)
+	}
+
+	return json.Unmarshal(plaintext, &v.keys)
+}
+
+// saveLocked encrypts and writes every key. v.mu must be held.
+func (v *Vault) saveLocked() error {
+	plaintext, err := json.Marshal(v.keys)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, v.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	data := v.aead.Seal(nonce, nonce, plaintext, nil)
+
+	if err := os.MkdirAll(filepath.Dir(v.path), 0700); err != nil {
+		return err
+	}
+	tmp := v.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write vault: %w", err)
+	}
+	if err := os.Rename(tmp, v.path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write vault: %w", err)
+	}
+	return nil
+}
+
+// Add validates and stores a private key, along with its certificate if one
+// is given. Encrypted keys are decrypted with the passphrase first, so the
+// passphrase is not needed again.
+func (v *Vault) Add(imp Import, createdBy string) (*Key, error) {
+	if len(imp.Machines) == 0 {
+		return nil, errors.New("at least one machine or tag is required")
+	}
+
+	var raw any
+	var err error
+	if imp.Passphrase != "" {
+		raw, err = ssh.ParseRawPrivateKeyWithPassphrase([]byte(imp.PrivateKey), []byte(imp.Passphrase))
+	} else {
+		raw, err = ssh.ParseRawPrivateKey([]byte(imp.PrivateKey))
+	}
+	if err != nil {
+		var missing *ssh.PassphraseMissingError
+		if errors.As(err, &missing) {
+			return nil, errors.New("private key is encrypted, a passphrase is required")
+		}
+		return nil, fmt.Errorf("invalid private key: %w", err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported private key: %w", err)
+	}
+
+	block, err := ssh.MarshalPrivateKey(raw, imp.Name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode private key: %w", err)
+	}
+
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+
+	pub := signer.PublicKey()
+	key := storedKey{
+		Key: Key{
+			ID:          id,
+			Name:        imp.Name,
+			Type:        pub.Type(),
+			Fingerprint: ssh.FingerprintSHA256(pub),
+			PublicKey:   strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub))),
+			Machines:    imp.Machines,
+			Users:       imp.Users,
+			CreatedBy:   createdBy,
+			CreatedAt:   time.Now(),
+		},
+		PrivateKey: string(pem.EncodeToMemory(block)),
+	}
+	if key.Name == "" {
+		key.Name = key.Fingerprint
+	}
+
+	if imp.Certificate != "" {
+		cert, err := parseCertificate(imp.Certificate, pub)
+		if err != nil {
+			return nil, err
+		}
+		key.Certificate = strings.TrimSpace(string(ssh.MarshalAuthorizedKey(cert)))
+		key.CertPrincipals = cert.ValidPrincipals
+		if cert.ValidBefore != ssh.CertTimeInfinity {
+			validBefore := time.Unix(int64(cert.ValidBefore), 0)
+			key.CertValidBefore = &validBefore
+		}
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.keys = append(v.keys, key)
+	if err := v.saveLocked(); err != nil {
+		v.keys = v.keys[:len(v.keys)-1]
+		return nil, err
+	}
+
+	k := key.Key
+	return &k, nil
+}
+
+func parseCertificate(s string, pub ssh.PublicKey) (*ssh.Certificate, error) {
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(s))
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate: %w", err)
+	}
+	cert, ok := parsed.(*ssh.Certificate)
+	if !ok {
+		return nil, errors.New("certificate is a plain public key, not an OpenSSH certificate")
+	}
+	if cert.CertType != ssh.UserCert {
+		return nil, errors.New("certificate is not a user certificate")
+	}
+	if string(cert.Key.Marshal()) != string(pub.Marshal()) {
+		return nil, errors.New("certificate does not match the private key")
+	}
+	return cert, nil
+}
+
+// List returns every key without private material, newest first.
+func (v *Vault) List() []Key {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	keys := make([]Key, 0, len(v.keys))
+	for _, k := range v.keys {
+		keys = append(keys, k.Key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.After(keys[j].CreatedAt)
+	})
+	return keys
+}
+
+// Update changes a key's name and bindings. Unless admin is set, the key
+// must have been added by caller.
+func (v *Vault) Update(id string, b Binding, caller string, admin bool) (*Key, error) {
+	if len(b.Machines) == 0 {
+		return nil, errors.New("at least one machine or tag is required")
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	for i := range v.keys {
+		if v.keys[i].ID != id {
+			continue
+		}
+		if !admin && (caller == "" || v.keys[i].CreatedBy != caller) {
+			return nil, ErrNotOwner
+		}
+		prev := v.keys[i]
+		if b.Name != nil {
+			v.keys[i].Name = *b.Name
+		}
+		v.keys[i].Machines = b.Machines
+		v.keys[i].Users = b.Users
+		if err := v.saveLocked(); err != nil {
+			v.keys[i] = prev
+			return nil, err
+		}
+		k := v.keys[i].Key
+		return &k, nil
+	}
+	return nil, ErrNotFound
+}
+
+// Delete removes a key. Unless admin is set, the key must have been added
+// by caller.
+func (v *Vault) Delete(id, caller string, admin bool) (*Key, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	for i, k := range v.keys {
+		if k.ID != id {
+			continue
+		}
+		if !admin && (caller == "" || k.CreatedBy != caller) {
+			return nil, ErrNotOwner
+		}
+		prev := v.keys
+		v.keys = append(append([]storedKey(nil), v.keys[:i]...), v.keys[i+1:]...)
+		if err := v.saveLocked(); err != nil {
+			v.keys = prev
+			return nil, err
+		}
+		return &k.Key, nil
+	}
+	return nil, ErrNotFound
+}
+
+// Signers returns signers for every key bound to machine and user. Keys
+// with a certificate yield the certificate first, then the bare key.
+func (v *Vault) Signers(ctx context.Context, machine, user string) ([]ssh.Signer, error) {
+	v.mu.Lock()
+	keys := append([]storedKey(nil), v.keys...)
+	v.mu.Unlock()
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	target, err := v.lookupMachine(ctx, machine)
+	if err != nil {
+		return nil, err
+	}
+
+	var signers []ssh.Signer
+	for _, k := range keys {
+		if !policy.MatchesMachine(k.Machines, target) || !matchesUser(k.Users, user) {
+			continue
+		}
+
+		signer, err := ssh.ParsePrivateKey([]byte(k.PrivateKey))
+		if err != nil {
+			log.Printf("Skipping unreadable vault key %s: %v", k.ID, err)
+			continue
+		}
+
+		if k.Certificate != "" {
+			if certSigner, err := certSigner(k.Certificate, signer); err == nil {
+				signers = append(signers, certSigner)
+			} else {
+				log.Printf("Skipping certificate for vault key %s: %v", k.ID, err)
+			}
+		}
+		signers = append(signers, signer)
+	}
+	return signers, nil
+}
+
+func certSigner(s string, signer ssh.Signer) (ssh.Signer, error) {
+	cert, err := parseCertificate(s, signer.PublicKey())
+	if err != nil {
+		return nil, err
+	}
+	if cert.ValidBefore != ssh.CertTimeInfinity && time.Now().After(time.Unix(int64(cert.ValidBefore), 0)) {
+		return nil, errors.New("certificate has expired")
+	}
+	return ssh.NewCertSigner(cert, signer)
+}
+
+func matchesUser(users []string, user string) bool {
+	if len(users) == 0 {
+		return true
+	}
+	for _, u := range users {
+		if u == "*" || u == user {
+			return true
+		}
+	}
+	return false
+}
+
+func newID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}